@@ -0,0 +1,172 @@
+// mqueuectl 导出, 导入和重放 mqueue 中的消息
+//
+//	mqueuectl export -uri mongodb://localhost -db app -coll queue -state dead -channel a,b -o dead.jsonl
+//	mqueuectl import -uri mongodb://localhost -db app -coll queue -i dead.jsonl -reset-delay
+//	mqueuectl replay -uri mongodb://localhost -db app -coll queue -channel a -since 2024-01-01T00:00:00Z -target a-replay
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(os.Args[2:])
+	case "import":
+		err = load(os.Args[2:])
+	case "replay":
+		err = replay(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: mqueuectl <export|import|replay> [flags]")
+	os.Exit(2)
+}
+
+type db struct {
+	uri, database, collection *string
+}
+
+func dbFlags(fs *flag.FlagSet) *db {
+	return &db{
+		uri:        fs.String("uri", "mongodb://localhost:27017", "MongoDB URI"),
+		database:   fs.String("db", "", "database"),
+		collection: fs.String("coll", "", "queue collection"),
+	}
+}
+
+func (d *db) open() (*mqueue.MQueue, error) {
+	if *d.database == "" || *d.collection == "" {
+		return nil, fmt.Errorf("-db and -coll are required")
+	}
+	// 索引和 TTL 由使用队列的服务维护, 这里不能按默认配置修改
+	return mqueue.NewMQueueE(mqueue.QueueOpts{
+		DB:          mqueue.DBConfig{URI: *d.uri, Database: *d.database, Collection: *d.collection},
+		SkipIndexes: true,
+	})
+}
+
+func channels(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	d := dbFlags(fs)
+	state := fs.String("state", "", "ready, in_flight, done or dead, empty for all")
+	channel := fs.String("channel", "", "comma separated channels, empty for all")
+	history := fs.Bool("history", false, "export archived messages from <coll>_history")
+	output := fs.String("o", "", "output file, default stdout")
+	fs.Parse(args)
+
+	mq, err := d.open()
+	if err != nil {
+		return err
+	}
+	defer mq.Close(context.Background())
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	count, err := mq.MessageV2.Export(context.Background(), w, mqueue.ExportOpts{
+		State:   mqueue.MessageState(*state),
+		Channel: channels(*channel),
+		History: *history,
+	})
+	fmt.Fprintf(os.Stderr, "exported %d messages\n", count)
+	return err
+}
+
+func load(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	d := dbFlags(fs)
+	input := fs.String("i", "", "input file, default stdin")
+	resetDelay := fs.Bool("reset-delay", false, "make pending messages visible immediately")
+	channel := fs.String("channel", "", "import into this channel instead of the original ones")
+	fs.Parse(args)
+
+	mq, err := d.open()
+	if err != nil {
+		return err
+	}
+	defer mq.Close(context.Background())
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	count, err := mq.MessageV2.Import(context.Background(), r, mqueue.ImportOpts{
+		ResetDelay: *resetDelay,
+		Channel:    *channel,
+	})
+	fmt.Fprintf(os.Stderr, "imported %d messages\n", count)
+	return err
+}
+
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	d := dbFlags(fs)
+	channel := fs.String("channel", "", "comma separated original channels, empty for all")
+	target := fs.String("target", "", "replay onto this channel instead of the original ones")
+	since := fs.String("since", "", "completed at or after, RFC3339")
+	until := fs.String("until", "", "completed before, RFC3339")
+	limit := fs.Int64("limit", 0, "max messages, 0 for no limit")
+	fs.Parse(args)
+
+	opts := mqueue.ReplayOpts{Channel: channels(*channel), Target: *target, Limit: *limit}
+	var err error
+	if *since != "" {
+		if opts.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		if opts.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+			return err
+		}
+	}
+
+	mq, err := d.open()
+	if err != nil {
+		return err
+	}
+	defer mq.Close(context.Background())
+
+	count, err := mq.MessageV2.Replay(context.Background(), opts)
+	fmt.Fprintf(os.Stderr, "replayed %d messages\n", count)
+	return err
+}
@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// W3C Trace Context
+	traceparentKey = "traceparent"
+)
+
+type contextKey int
+
+const (
+	reqidContextKey contextKey = iota
+	traceparentContextKey
+)
+
+// WithReqId 在 gin 以外 (如队列消费者) 传递请求 ID
+func WithReqId(ctx context.Context, reqId string) context.Context {
+	return context.WithValue(ctx, reqidContextKey, reqId)
+}
+
+// ReqIdFromContext *gin.Context 时读取 NewGinMiddleware 设置的 X-Reqid
+func ReqIdFromContext(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		if reqId := c.Request.Header.Get(reqidKey); reqId != "" {
+			return reqId
+		}
+	}
+	reqId, _ := ctx.Value(reqidContextKey).(string)
+	return reqId
+}
+
+// WithTraceparent
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceparentContextKey, traceparent)
+}
+
+// TraceparentFromContext *gin.Context 时读取请求头中的 traceparent
+func TraceparentFromContext(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		if traceparent := c.Request.Header.Get(traceparentKey); traceparent != "" {
+			return traceparent
+		}
+	}
+	traceparent, _ := ctx.Value(traceparentContextKey).(string)
+	return traceparent
+}
+
+// FromContext 带有请求 ID 和 traceparent 字段的日志
+func FromContext(ctx context.Context) *logrus.Entry {
+	fields := logrus.Fields{}
+	if reqId := ReqIdFromContext(ctx); reqId != "" {
+		fields["reqid"] = reqId
+	}
+	if traceparent := TraceparentFromContext(ctx); traceparent != "" {
+		fields["traceparent"] = traceparent
+	}
+	return GetLogger().WithFields(fields)
+}
@@ -57,6 +57,12 @@ func NewGinMiddleware(logger *logrus.Logger) gin.HandlerFunc {
 		}
 		h := c.Writer.Header()
 		h.Set(reqidKey, reqId)
+		// 使用 c.Request.Context() 的代码 (如 mqueue.Add) 也能读到请求 ID
+		ctx := WithReqId(c.Request.Context(), reqId)
+		if traceparent := c.Request.Header.Get(traceparentKey); traceparent != "" {
+			ctx = WithTraceparent(ctx, traceparent)
+		}
+		c.Request = c.Request.WithContext(ctx)
 
 		hostname, err := os.Hostname()
 		if err != nil {
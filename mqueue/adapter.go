@@ -0,0 +1,68 @@
+package mqueue
+
+import (
+	"context"
+	"time"
+)
+
+// NewMessageNodeV1 将 IMessageNodeV2 的实现 (如 MemoryNode) 包装为 IMessageNode
+func NewMessageNodeV1(node IMessageNodeV2) IMessageNode {
+	return &messageNodeV1{node: node}
+}
+
+type messageNodeV1 struct {
+	node IMessageNodeV2
+}
+
+func (a *messageNodeV1) Add(message ...Message) bool {
+	_, err := a.node.Add(context.Background(), message...)
+	return err == nil
+}
+
+func (a *messageNodeV1) Clear() bool {
+	return a.node.Clear(context.Background()) == nil
+}
+
+func (a *messageNodeV1) Get() (*QueueMessage, bool) {
+	message, err := a.node.Get(context.Background())
+	return message, err == nil
+}
+
+// Watch 返回的 channel 不会关闭
+func (a *messageNodeV1) Watch(interval time.Duration) chan *QueueMessage {
+	c := make(chan *QueueMessage)
+	go func() {
+		for message := range a.node.Watch(context.Background(), interval) {
+			c <- message
+		}
+	}()
+	return c
+}
+
+func (a *messageNodeV1) Ack(ack string) bool {
+	return a.node.Ack(context.Background(), ack) == nil
+}
+
+func (a *messageNodeV1) Ping(ack string) bool {
+	return a.node.Ping(context.Background(), ack) == nil
+}
+
+func (a *messageNodeV1) Total() (int64, error) {
+	return a.node.Total(context.Background())
+}
+
+func (a *messageNodeV1) Size() (int64, error) {
+	return a.node.Size(context.Background())
+}
+
+func (a *messageNodeV1) InFlight() (int64, error) {
+	return a.node.InFlight(context.Background())
+}
+
+func (a *messageNodeV1) Done() (int64, error) {
+	return a.node.Done(context.Background())
+}
+
+func (a *messageNodeV1) Dead() (int64, error) {
+	return a.node.Dead(context.Background())
+}
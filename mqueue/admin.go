@@ -0,0 +1,221 @@
+package mqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yaoshangnetwork/gobase/response"
+	"github.com/yaoshangnetwork/gobase/response/commerrs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RegisterAdminRoutes 注册队列管理接口, 返回 response.Success/response.Error 格式.
+// 需要鉴权时传入挂载了 jwt 中间件的路由组:
+//
+//	g := r.Group("/mqueue", jwt.NewGinMiddleware(secret))
+//	mqueue.RegisterAdminRoutes(g, mq)
+func RegisterAdminRoutes(router gin.IRouter, mq *MQueue) {
+	a := &admin{node: mq.MessageV2}
+	router.GET("/stats", a.stats)
+	router.GET("/messages", a.list)
+	router.GET("/messages/:id", a.get)
+	router.POST("/messages/:id/requeue", a.requeue)
+	router.DELETE("/messages/:id", a.delete)
+	router.POST("/dead/requeue", a.requeueAll)
+	router.DELETE("/dead", a.purge)
+	router.GET("/channels", a.channels)
+	router.POST("/channels/pause", a.pause)
+	router.POST("/channels/resume", a.resume)
+	router.POST("/channels/rate", a.rate)
+}
+
+type admin struct {
+	node *MessageNodeV2
+}
+
+type messageView struct {
+	ID            string            `json:"id"`
+	Channel       string            `json:"channel"`
+	Message       json.RawMessage   `json:"message"`
+	Tries         int               `json:"tries"`
+	MaxTries      int               `json:"max_tries"`
+	Priority      int               `json:"priority"`
+	GroupKey      string            `json:"group_key,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	LastError     string            `json:"last_error,omitempty"`
+	Failures      []Failure         `json:"failures"`
+	Created       time.Time         `json:"created"`
+	Visible       time.Time         `json:"visible"`
+	Dead          bool              `json:"dead"`
+	Deleted       *time.Time        `json:"deleted"`
+}
+
+func newMessageView(m *MessageInfo) *messageView {
+	failures := m.Failures
+	if failures == nil {
+		failures = []Failure{}
+	}
+	return &messageView{
+		ID:            m.ID.Hex(),
+		Channel:       m.Channel,
+		Message:       toJSON(m.Message),
+		Tries:         m.Tries,
+		MaxTries:      m.MaxTries,
+		Priority:      m.Priority,
+		GroupKey:      m.GroupKey,
+		CorrelationID: m.CorrelationID,
+		Headers:       m.Headers,
+		LastError:     m.LastError,
+		Failures:      failures,
+		Created:       m.Created,
+		Visible:       m.Visible,
+		Dead:          m.Dead,
+		Deleted:       m.Deleted,
+	}
+}
+
+// toJSON 消息内容转为 relaxed extended JSON, 避免 primitive.D 被序列化为 Key/Value 数组
+func toJSON(v any) json.RawMessage {
+	b, err := bson.MarshalExtJSON(bson.M{"v": v}, false, false)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return json.RawMessage("null")
+	}
+	return doc["v"]
+}
+
+func adminError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		response.Error(ctx, commerrs.ErrDataNotFound)
+	case errors.Is(err, primitive.ErrInvalidHex):
+		response.Error(ctx, commerrs.ErrInvalidObjectID)
+	case errors.Is(err, ErrInvalidState), errors.Is(err, ErrInvalidMessage):
+		response.Error(ctx, commerrs.ErrInvalidParams)
+	default:
+		response.Error(ctx, err)
+	}
+}
+
+// channelsQuery 支持 ?channel=a&channel=b
+func channelsQuery(ctx *gin.Context) []string {
+	return ctx.QueryArray("channel")
+}
+
+func (a *admin) stats(ctx *gin.Context) {
+	stats, err := a.node.Stats(ctx, channelsQuery(ctx)...)
+	response.JSON(ctx, stats, err)
+}
+
+// list ?state=ready|in_flight|done|dead&channel=&page=1&size=20
+func (a *admin) list(ctx *gin.Context) {
+	page, err := strconv.ParseInt(ctx.DefaultQuery("page", "1"), 10, 64)
+	if err != nil || page < 1 {
+		response.Error(ctx, commerrs.ErrInvalidParams)
+		return
+	}
+	size, err := strconv.ParseInt(ctx.DefaultQuery("size", "20"), 10, 64)
+	if err != nil || size < 1 || size > 1000 {
+		response.Error(ctx, commerrs.ErrInvalidParams)
+		return
+	}
+	messages, total, err := a.node.List(ctx, MessageState(ctx.Query("state")), page, size, channelsQuery(ctx)...)
+	if err != nil {
+		adminError(ctx, err)
+		return
+	}
+	list := make([]*messageView, 0, len(messages))
+	for _, m := range messages {
+		list = append(list, newMessageView(m))
+	}
+	response.Success(ctx, gin.H{"list": list, "total": total})
+}
+
+func (a *admin) get(ctx *gin.Context) {
+	message, err := a.node.FindMessage(ctx, ctx.Param("id"))
+	if err != nil {
+		adminError(ctx, err)
+		return
+	}
+	response.Success(ctx, newMessageView(message))
+}
+
+// requeue 只能重新投递死信
+func (a *admin) requeue(ctx *gin.Context) {
+	if err := a.node.Requeue(ctx, ctx.Param("id")); err != nil {
+		adminError(ctx, err)
+		return
+	}
+	response.Success(ctx, nil)
+}
+
+// delete 只能删除死信
+func (a *admin) delete(ctx *gin.Context) {
+	if err := a.node.DeleteDead(ctx, ctx.Param("id")); err != nil {
+		adminError(ctx, err)
+		return
+	}
+	response.Success(ctx, nil)
+}
+
+func (a *admin) requeueAll(ctx *gin.Context) {
+	count, err := a.node.RequeueAll(ctx, channelsQuery(ctx)...)
+	response.JSON(ctx, gin.H{"count": count}, err)
+}
+
+func (a *admin) purge(ctx *gin.Context) {
+	count, err := a.node.PurgeDead(ctx, channelsQuery(ctx)...)
+	response.JSON(ctx, gin.H{"count": count}, err)
+}
+
+func (a *admin) channels(ctx *gin.Context) {
+	controls, err := a.node.Controls(ctx)
+	response.JSON(ctx, controls, err)
+}
+
+// pause ?channel=
+func (a *admin) pause(ctx *gin.Context) {
+	if err := a.node.Pause(ctx, ctx.Query("channel")); err != nil {
+		adminError(ctx, err)
+		return
+	}
+	response.Success(ctx, nil)
+}
+
+// resume ?channel=
+func (a *admin) resume(ctx *gin.Context) {
+	if err := a.node.Resume(ctx, ctx.Query("channel")); err != nil {
+		adminError(ctx, err)
+		return
+	}
+	response.Success(ctx, nil)
+}
+
+// rate ?channel=&limit=10&interval=1s, limit=0 取消限流
+func (a *admin) rate(ctx *gin.Context) {
+	limit, err := strconv.Atoi(ctx.Query("limit"))
+	if err != nil {
+		response.Error(ctx, commerrs.ErrInvalidParams)
+		return
+	}
+	var interval time.Duration
+	if v := ctx.Query("interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			response.Error(ctx, commerrs.ErrInvalidParams)
+			return
+		}
+	}
+	if err := a.node.SetRateLimit(ctx, ctx.Query("channel"), limit, interval); err != nil {
+		adminError(ctx, err)
+		return
+	}
+	response.Success(ctx, nil)
+}
@@ -0,0 +1,62 @@
+package mqueue_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"github.com/yaoshangnetwork/gobase/response/commerrs"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 参数校验在访问数据库之前完成, 不需要 MongoDB
+func TestAdminValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	// Connect 不会立即建立连接
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	mq, err := mqueue.NewMQueueWithDatabaseE(client.Database("mqueue_test"), mqueue.QueueOpts{
+		DB:          mqueue.DBConfig{Collection: "admin"},
+		SkipIndexes: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	mqueue.RegisterAdminRoutes(router.Group("/mqueue"), mq)
+
+	for _, item := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/mqueue/messages/bad-id", commerrs.ErrInvalidObjectID.Code},
+		{http.MethodPost, "/mqueue/messages/bad-id/requeue", commerrs.ErrInvalidObjectID.Code},
+		{http.MethodDelete, "/mqueue/messages/bad-id", commerrs.ErrInvalidObjectID.Code},
+		{http.MethodGet, "/mqueue/messages?state=unknown", commerrs.ErrInvalidParams.Code},
+		{http.MethodGet, "/mqueue/messages?size=0", commerrs.ErrInvalidParams.Code},
+		{http.MethodGet, "/mqueue/messages?size=1001", commerrs.ErrInvalidParams.Code},
+		{http.MethodGet, "/mqueue/messages?page=x", commerrs.ErrInvalidParams.Code},
+		{http.MethodPost, "/mqueue/channels/pause", commerrs.ErrInvalidParams.Code},
+		{http.MethodPost, "/mqueue/channels/rate?channel=a&limit=x", commerrs.ErrInvalidParams.Code},
+		{http.MethodPost, "/mqueue/channels/rate?channel=a&limit=10", commerrs.ErrInvalidParams.Code},
+		{http.MethodPost, "/mqueue/channels/rate?channel=a&limit=10&interval=x", commerrs.ErrInvalidParams.Code},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(item.method, item.path, nil))
+		var body struct {
+			Code int `json:"code"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != item.code {
+			t.Error(item.method, item.path, w.Body.String())
+		}
+	}
+}
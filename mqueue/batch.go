@@ -0,0 +1,200 @@
+package mqueue
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type picked struct {
+	id      primitive.ObjectID
+	channel string
+	window  time.Time // 限流窗口, 见 scan
+}
+
+// GetBatch 一次获取 channel 上最多 n 条消息, 每条消息有各自的 ack, 同一分组每次最多返回一条;
+// 没有可获取的消息时返回 ErrEmpty
+func (n *MessageNodeV2) GetBatch(ctx context.Context, channel string, size int) ([]*QueueMessage, error) {
+	if channel == "" || size <= 0 {
+		return nil, ErrInvalidMessage
+	}
+	for {
+		picks := make([]picked, 0, size)
+		err := n.scan(ctx, []string{channel}, func(c *candidate, window time.Time) (bool, error) {
+			picks = append(picks, picked{id: c.ID, channel: c.Channel, window: window})
+			return len(picks) >= size, nil
+		})
+		if err == nil && len(picks) == 0 {
+			return nil, ErrEmpty
+		}
+		var messages []*QueueMessage
+		if err == nil {
+			messages, err = n.leaseMany(ctx, picks)
+		}
+		n.releaseUnleased(ctx, picks, messages)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]*QueueMessage, 0, len(messages))
+		dead := make([]string, 0)
+		for _, message := range messages {
+			if message.Tries > message.MaxTries {
+				dead = append(dead, message.Ack)
+				continue
+			}
+			if err := n.prepare(message); err != nil {
+				// 与 Get 一致, 无法解码的消息单独进入死信, 不影响同批的其他消息
+				if err := n.markDead(ctx, []string{message.Ack}, err.Error()); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			result = append(result, message)
+		}
+		if err := n.markDead(ctx, dead, ""); err != nil {
+			return nil, err
+		}
+		if len(result) > 0 {
+			return result, nil
+		}
+		// 全部被其他消费者获取或进入死信, 重新查找
+	}
+}
+
+// leaseMany 一次 UpdateMany 对仍然可见的消息设置租约, 再按批次标记取回实际获取到的消息, 按 picks 的顺序返回
+func (n *MessageNodeV2) leaseMany(ctx context.Context, picks []picked) ([]*QueueMessage, error) {
+	ids := make([]primitive.ObjectID, 0, len(picks))
+	order := make(map[primitive.ObjectID]int, len(picks))
+	for i, p := range picks {
+		ids = append(ids, p.id)
+		order[p.id] = i
+	}
+	now := n.node.now()
+	batch := id()
+	query := bson.M{"_id": bson.M{"$in": ids}, "visible": bson.M{"$lte": now}, "dead": false, "deleted": nil}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tries": bson.M{"$add": bson.A{"$tries", 1}},
+			"batch": batch,
+			// ack 需要唯一, 由批次和消息 ID 生成
+			"ack":     bson.M{"$concat": bson.A{batch, "-", bson.M{"$toString": "$_id"}}},
+			"visible": n.leaseUntil(now),
+		}}},
+	}
+	res, err := n.node.coll.UpdateMany(ctx, query, update)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*QueueMessage, 0, res.ModifiedCount)
+	if res.ModifiedCount == 0 {
+		return messages, nil
+	}
+
+	cursor, err := n.node.coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "batch": batch})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return order[messages[i].ID] < order[messages[j].ID]
+	})
+	return messages, nil
+}
+
+// releaseUnleased 归还没有获取到的消息占用的限流次数
+func (n *MessageNodeV2) releaseUnleased(ctx context.Context, picks []picked, messages []*QueueMessage) {
+	leased := make(map[primitive.ObjectID]bool, len(messages))
+	for _, message := range messages {
+		leased[message.ID] = true
+	}
+	for _, p := range picks {
+		if !p.window.IsZero() && !leased[p.id] {
+			_ = n.release(ctx, p.channel, p.window)
+		}
+	}
+}
+
+// markDead 将超过重试次数或无法解码的消息标记为死信, reason 不为空时记录到 last_error
+func (n *MessageNodeV2) markDead(ctx context.Context, acks []string, reason string) error {
+	if len(acks) == 0 {
+		return nil
+	}
+	now := n.node.now()
+	set := bson.M{"dead": true, "deleted": now, "dead_at": now}
+	if reason != "" {
+		set["last_error"] = reason
+	}
+	res, err := n.node.coll.UpdateMany(ctx, bson.M{"ack": bson.M{"$in": acks}}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	n.node.metrics.incDead(int(res.ModifiedCount))
+	return nil
+}
+
+// prepare 解码消息内容, 设置租约时长和回复方式
+func (n *MessageNodeV2) prepare(message *QueueMessage) error {
+	payload, err := n.node.codec.decode(message.Message)
+	if err != nil {
+		return err
+	}
+	message.Message = payload
+	message.Lease = message.Visibility
+	if message.Lease <= 0 {
+		message.Lease = n.node.leaseVisibility()
+	}
+	message.replier = n.reply
+	return nil
+}
+
+// AckBatch 通过一次 BulkWrite 确认多条消息, 返回成功的数量, 不存在或租约已过期的 ack 被忽略
+func (n *MessageNodeV2) AckBatch(ctx context.Context, acks []string) (int64, error) {
+	if len(acks) == 0 {
+		return 0, nil
+	}
+	now := n.node.now()
+	models := make([]mongo.WriteModel, 0, len(acks))
+	for _, ack := range acks {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"ack": ack, "visible": bson.M{"$gt": now}, "dead": false, "deleted": nil}).
+			SetUpdate(bson.M{"$set": bson.M{"deleted": now}}))
+	}
+	res, err := n.node.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	n.node.metrics.incAcked(int(res.ModifiedCount))
+
+	if n.node.archive && res.ModifiedCount > 0 {
+		n.archiveBatch(ctx, acks, now, int(res.ModifiedCount))
+	}
+	return res.ModifiedCount, nil
+}
+
+// archiveBatch 将 AckBatch 确认的消息写入历史集合, 失败时与 Ack 一样只记录
+func (n *MessageNodeV2) archiveBatch(ctx context.Context, acks []string, deleted time.Time, count int) {
+	cursor, err := n.node.coll.Find(ctx, bson.M{"ack": bson.M{"$in": acks}, "deleted": deleted})
+	if err != nil {
+		n.archiveFailed(count, err)
+		return
+	}
+	defer cursor.Close(ctx)
+	docs := make([]bson.Raw, 0, count)
+	for cursor.Next(ctx) {
+		docs = append(docs, bson.Raw(append([]byte(nil), cursor.Current...)))
+	}
+	if err := cursor.Err(); err != nil {
+		n.archiveFailed(count, err)
+		return
+	}
+	n.archiveAcked(ctx, docs...)
+}
@@ -0,0 +1,123 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MessageState string
+
+const (
+	StateReady    MessageState = "ready"
+	StateInFlight MessageState = "in_flight"
+	StateDone     MessageState = "done"
+	StateDead     MessageState = "dead"
+)
+
+// stateQuery 与 Size/InFlight/Done/Dead 的条件一致, state 为空时不限制
+func stateQuery(state MessageState, now time.Time) (bson.M, error) {
+	switch state {
+	case "":
+		return bson.M{}, nil
+	case StateReady:
+		return bson.M{"visible": bson.M{"$lte": now}, "dead": false, "deleted": nil}, nil
+	case StateInFlight:
+		return bson.M{"visible": bson.M{"$gt": now}, "dead": false, "deleted": nil}, nil
+	case StateDone:
+		return bson.M{"deleted": bson.M{"$exists": true}}, nil
+	case StateDead:
+		return bson.M{"dead": true}, nil
+	}
+	return nil, ErrInvalidState
+}
+
+// MessageInfo 消息的完整信息, 用于查看和排查
+type MessageInfo struct {
+	QueueMessage `bson:",inline"`
+	Created      time.Time  `bson:"created"`
+	Visible      time.Time  `bson:"visible"`
+	Dead         bool       `bson:"dead"`
+	Deleted      *time.Time `bson:"deleted"`
+	Failures     []Failure  `bson:"failures"`
+}
+
+// List 按状态和 channel 分页查看消息, page 从 1 开始
+func (n *MessageNodeV2) List(ctx context.Context, state MessageState, page int64, size int64, channel ...string) ([]*MessageInfo, int64, error) {
+	result := make([]*MessageInfo, 0, size)
+	query, err := stateQuery(state, n.node.now())
+	if err != nil {
+		return result, 0, err
+	}
+	query = byChannel(query, channel)
+	if page < 1 {
+		page = 1
+	}
+
+	cursor, err := n.node.coll.Find(
+		ctx,
+		query,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetSkip((page-1)*size).SetLimit(size),
+	)
+	if err != nil {
+		return result, 0, err
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &result); err != nil {
+		return result, 0, err
+	}
+	for _, item := range result {
+		n.decodeForView(&item.QueueMessage)
+	}
+
+	count, err := n.node.coll.CountDocuments(ctx, query)
+	if err != nil {
+		return result, 0, err
+	}
+	return result, count, nil
+}
+
+// FindMessage 消息不存在时返回 ErrNotFound
+func (n *MessageNodeV2) FindMessage(ctx context.Context, messageID string) (*MessageInfo, error) {
+	oid, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, err
+	}
+	result := new(MessageInfo)
+	if err := n.node.coll.FindOne(ctx, bson.M{"_id": oid}).Decode(result); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	n.decodeForView(&result.QueueMessage)
+	return result, nil
+}
+
+// decodeForView 查看消息时尽量还原内容, 无法解密时保留原值
+func (n *MessageNodeV2) decodeForView(message *QueueMessage) {
+	if payload, err := n.node.codec.decode(message.Message); err == nil {
+		message.Message = payload
+	}
+}
+
+// DeleteDead 删除一条死信, 不是死信时返回 ErrNotFound
+func (n *MessageNodeV2) DeleteDead(ctx context.Context, messageID string) error {
+	oid, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return err
+	}
+	res, err := n.node.coll.DeleteOne(ctx, bson.M{"_id": oid, "dead": true})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package mqueue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+
+	DefaultCompressThreshold = 1024
+)
+
+// CodecOpts 消息内容写入前先压缩再加密, Get 时自动解密和解压.
+// 只处理消息内容, 其他字段 (channel, headers 等) 仍为明文以便查询
+type CodecOpts struct {
+	Compression Compression
+	// 编码后超过该字节数才压缩, 默认 DefaultCompressThreshold
+	CompressThreshold int
+	// 密钥 ID 到 AES 密钥 (16, 24 或 32 字节) 的映射, 为空时不加密.
+	// 轮换密钥时新增密钥并修改 KeyID, 旧密钥保留到使用它加密的消息全部过期
+	Keys map[string][]byte
+	// 加密新消息使用的密钥 ID
+	KeyID string
+}
+
+// 编码后的消息内容, 以第一个字段区分普通消息
+const envelopeKey = "_mqcodec"
+
+type envelope struct {
+	Version     int         `bson:"_mqcodec"`
+	Compression Compression `bson:"compression,omitempty"`
+	KeyID       string      `bson:"key_id,omitempty"`
+	Data        []byte      `bson:"data"`
+}
+
+type codec struct {
+	compression Compression
+	threshold   int
+	keyID       string
+	aeads       map[string]cipher.AEAD
+}
+
+// newCodec opts 为 nil 时返回 nil, 不编码
+func newCodec(opts *CodecOpts) (*codec, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	c := &codec{
+		compression: opts.Compression,
+		threshold:   opts.CompressThreshold,
+		keyID:       opts.KeyID,
+		aeads:       make(map[string]cipher.AEAD, len(opts.Keys)),
+	}
+	switch c.compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression %q", ErrInvalidCodec, c.compression)
+	}
+	if c.threshold <= 0 {
+		c.threshold = DefaultCompressThreshold
+	}
+	for id, key := range opts.Keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %v", ErrInvalidCodec, id, err)
+		}
+		if c.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if c.keyID != "" && c.aeads[c.keyID] == nil {
+		return nil, fmt.Errorf("%w: key %q not found", ErrInvalidCodec, c.keyID)
+	}
+	return c, nil
+}
+
+// encode 返回写入 message 字段的值, 未配置或不需要处理时原样返回
+func (c *codec) encode(payload any) (any, error) {
+	if c == nil || (c.compression == CompressionNone && c.keyID == "") {
+		return payload, nil
+	}
+	data, err := bson.Marshal(bson.D{{Key: "v", Value: payload}})
+	if err != nil {
+		return nil, err
+	}
+	env := &envelope{Version: 1}
+	if c.compression != CompressionNone && len(data) > c.threshold {
+		if data, err = compress(c.compression, data); err != nil {
+			return nil, err
+		}
+		env.Compression = c.compression
+	}
+	if c.keyID != "" {
+		aead := c.aeads[c.keyID]
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		data = aead.Seal(nonce, nonce, data, []byte(c.keyID))
+		env.KeyID = c.keyID
+	}
+	if env.Compression == CompressionNone && env.KeyID == "" {
+		return payload, nil
+	}
+	env.Data = data
+	return env, nil
+}
+
+// decode 还原 encode 的结果, 不是编码后的消息时原样返回; 只压缩的消息在未配置时也可以解码
+func (c *codec) decode(message any) (any, error) {
+	d, ok := message.(primitive.D)
+	if !ok || len(d) == 0 || d[0].Key != envelopeKey {
+		return message, nil
+	}
+	raw, err := bson.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	env := new(envelope)
+	if err := bson.Unmarshal(raw, env); err != nil {
+		return nil, err
+	}
+
+	data := env.Data
+	if env.KeyID != "" {
+		var aead cipher.AEAD
+		if c != nil {
+			aead = c.aeads[env.KeyID]
+		}
+		if aead == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, env.KeyID)
+		}
+		if len(data) < aead.NonceSize() {
+			return nil, fmt.Errorf("mqueue: decrypt message: ciphertext too short")
+		}
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		if data, err = aead.Open(nil, nonce, ciphertext, []byte(env.KeyID)); err != nil {
+			return nil, fmt.Errorf("mqueue: decrypt message: %w", err)
+		}
+	}
+	if env.Compression != CompressionNone {
+		if data, err = decompress(env.Compression, data); err != nil {
+			return nil, fmt.Errorf("mqueue: decompress message: %w", err)
+		}
+	}
+
+	var payload any
+	if err := bson.Raw(data).Lookup("v").Unmarshal(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+func compress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		buf := new(bytes.Buffer)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported compression %q", ErrInvalidCodec, compression)
+}
+
+func decompress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("%w: unsupported compression %q", ErrInvalidCodec, compression)
+}
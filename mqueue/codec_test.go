@@ -0,0 +1,124 @@
+package mqueue_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCodec(t *testing.T) {
+	ctx := context.Background()
+	keys := map[string][]byte{
+		"k1": []byte("0123456789abcdef"),
+		"k2": []byte("0123456789abcdef0123456789abcdef"),
+	}
+	type payload struct {
+		Name string `bson:"name"`
+		Body string `bson:"body"`
+	}
+	want := payload{Name: "x", Body: strings.Repeat("a", 4096)}
+
+	for _, opts := range []*mqueue.CodecOpts{
+		{Compression: mqueue.CompressionGzip},
+		{Compression: mqueue.CompressionZstd, CompressThreshold: 16},
+		{Keys: keys, KeyID: "k1"},
+		{Compression: mqueue.CompressionZstd, Keys: keys, KeyID: "k2"},
+	} {
+		node := mqueue.NewMemoryNode(mqueue.MemoryOpts{Codec: opts})
+		if _, err := node.Add(ctx, mqueue.Message{Channel: "a", Message: want, MaxTries: 1}, mqueue.Message{Channel: "a", Message: "small", MaxTries: 1}); err != nil {
+			t.Fatal(err)
+		}
+		message, err := node.Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got payload
+		if !message.MessageDecode(&got) || got != want {
+			t.Error("decode error", opts)
+		}
+		if message, err = node.Get(ctx); err != nil || message.Message != "small" {
+			t.Error("decode error", opts, err)
+		}
+	}
+}
+
+func TestInvalidCodec(t *testing.T) {
+	for _, opts := range []*mqueue.CodecOpts{
+		{Compression: "lz4"},
+		{Keys: map[string][]byte{"k1": []byte("short")}, KeyID: "k1"},
+		{Keys: map[string][]byte{"k1": []byte("0123456789abcdef")}, KeyID: "k2"},
+	} {
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, mqueue.ErrInvalidCodec) {
+					t.Error("expect ErrInvalidCodec", opts)
+				}
+			}()
+			mqueue.NewMemoryNode(mqueue.MemoryOpts{Codec: opts})
+		}()
+	}
+}
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行, 检查写入的文档和密钥轮换
+func TestMongoCodec(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	k1, k2 := []byte("0123456789abcdef"), []byte("0123456789abcdef0123456789abcdef")
+	collection := "codec_" + primitive.NewObjectID().Hex()
+	open := func(codec *mqueue.CodecOpts) *mqueue.MessageNodeV2 {
+		mq, err := mqueue.NewMQueueE(mqueue.QueueOpts{
+			Mode:  mqueue.DebugMode,
+			DB:    mqueue.DBConfig{URI: uri, Database: "mqueue_test", Collection: collection},
+			Codec: codec,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mq.Close(ctx) })
+		return mq.MessageV2
+	}
+	secret := strings.Repeat("secret", 300)
+
+	old := open(&mqueue.CodecOpts{Compression: mqueue.CompressionGzip, Keys: map[string][]byte{"k1": k1}, KeyID: "k1"})
+	defer old.Clear(ctx)
+	old.Add(ctx, mqueue.Message{Channel: "a", Message: secret, MaxTries: 1}, mqueue.Message{Channel: "a", Message: secret, MaxTries: 1})
+
+	// 存储的是密文
+	buf := new(bytes.Buffer)
+	if _, err := old.Export(ctx, buf, mqueue.ExportOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.Contains(line, `"_mqcodec"`) || !strings.Contains(line, `"key_id":"k1"`) || !strings.Contains(line, `"compression":"gzip"`) {
+			t.Error("expect envelope", line)
+		}
+		if strings.Contains(line, "secret") {
+			t.Error("payload stored in plaintext")
+		}
+	}
+
+	// 切换到 k2 后仍能读取 k1 加密的消息
+	rotated := open(&mqueue.CodecOpts{Keys: map[string][]byte{"k1": k1, "k2": k2}, KeyID: "k2"})
+	if message, err := rotated.Get(ctx, "a"); err != nil || message.Message != secret {
+		t.Error("read after rotation", err)
+	}
+
+	// 删除 k1 后消息进入死信, last_error 为 ErrUnknownKey
+	removed := open(&mqueue.CodecOpts{Keys: map[string][]byte{"k2": k2}, KeyID: "k2"})
+	if _, err := removed.Get(ctx, "a"); !errors.Is(err, mqueue.ErrEmpty) {
+		t.Error("expect ErrEmpty", err)
+	}
+	dead, _, err := removed.DeadList(ctx, 1, 10, "a")
+	if err != nil || len(dead) != 1 || !strings.Contains(dead[0].LastError, mqueue.ErrUnknownKey.Error()) {
+		t.Error("expect dead letter with ErrUnknownKey", dead, err)
+	}
+}
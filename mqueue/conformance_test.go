@@ -0,0 +1,457 @@
+package mqueue_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testVisibility = time.Minute
+
+type newNode func(t *testing.T, clock mqueue.Clock) mqueue.IMessageNodeV2
+
+func TestMemoryConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T, clock mqueue.Clock) mqueue.IMessageNodeV2 {
+		return mqueue.NewMemoryNode(mqueue.MemoryOpts{Visibility: testVisibility, Clock: clock})
+	})
+}
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行, 每个用例使用单独的集合
+func TestMongoConformance(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	runConformance(t, func(t *testing.T, clock mqueue.Clock) mqueue.IMessageNodeV2 {
+		mq, err := mqueue.NewMQueueE(mqueue.QueueOpts{
+			Mode:       mqueue.DebugMode,
+			DB:         mqueue.DBConfig{URI: uri, Database: "mqueue_test", Collection: "conformance_" + primitive.NewObjectID().Hex()},
+			Visibility: testVisibility,
+			Clock:      clock,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			mq.MessageV2.Clear(context.Background())
+			mq.Close(context.Background())
+		})
+		return mq.MessageV2
+	})
+}
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoExportImport(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	open := func() *mqueue.MQueue {
+		mq, err := mqueue.NewMQueueE(mqueue.QueueOpts{
+			Mode: mqueue.DebugMode,
+			DB:   mqueue.DBConfig{URI: uri, Database: "mqueue_test", Collection: "export_" + primitive.NewObjectID().Hex()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			mq.MessageV2.Clear(ctx)
+			mq.Close(ctx)
+		})
+		return mq
+	}
+	src, dst := open(), open()
+	src.MessageV2.Add(ctx,
+		mqueue.Message{Channel: "a", Message: map[string]any{"n": 1}, MaxTries: 1},
+		mqueue.Message{Channel: "a", Message: "delayed", MaxTries: 1, Delay: time.Hour},
+		mqueue.Message{Channel: "b", Message: "other", MaxTries: 1},
+	)
+
+	buf := new(bytes.Buffer)
+	if count, err := src.MessageV2.Export(ctx, buf, mqueue.ExportOpts{Channel: []string{"a"}}); err != nil || count != 2 {
+		t.Fatal("export error", count, err)
+	}
+	data := buf.Bytes()
+	if count, err := dst.MessageV2.Import(ctx, bytes.NewReader(data), mqueue.ImportOpts{ResetDelay: true}); err != nil || count != 2 {
+		t.Fatal("import error", count, err)
+	}
+	// 重复导入被跳过
+	if count, err := dst.MessageV2.Import(ctx, bytes.NewReader(data), mqueue.ImportOpts{}); err != nil || count != 0 {
+		t.Error("reimport error", count, err)
+	}
+	if size, _ := dst.MessageV2.Size(ctx, "a"); size != 2 {
+		t.Error("reset delay error", size)
+	}
+}
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoSkipIndexes(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	mq, err := mqueue.NewMQueueE(mqueue.QueueOpts{
+		Mode:        mqueue.DebugMode,
+		DB:          mqueue.DBConfig{URI: uri, Database: "mqueue_test", Collection: "skip_" + primitive.NewObjectID().Hex()},
+		SkipIndexes: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close(ctx)
+	defer mq.MessageV2.Clear(ctx)
+	mq.MessageV2.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 1})
+	if status, err := mq.Health(ctx); !errors.Is(err, mqueue.ErrMissingIndex) || status.Indexes {
+		t.Error("indexes should not be created", status, err)
+	}
+}
+
+func runConformance(t *testing.T, create newNode) {
+	ctx := context.Background()
+	setup := func(t *testing.T) (mqueue.IMessageNodeV2, *mqueue.ManualClock) {
+		// MongoDB 中的时间精确到毫秒
+		clock := mqueue.NewManualClock(time.Now().Truncate(time.Millisecond))
+		return create(t, clock), clock
+	}
+	count := func(t *testing.T, f func(context.Context, ...string) (int64, error), want int64) {
+		t.Helper()
+		got, err := f(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("count %d, want %d", got, want)
+		}
+	}
+	empty := func(t *testing.T, node mqueue.IMessageNodeV2, channel ...string) {
+		t.Helper()
+		if _, err := node.Get(ctx, channel...); !errors.Is(err, mqueue.ErrEmpty) {
+			t.Error("expect ErrEmpty", err)
+		}
+	}
+	get := func(t *testing.T, node mqueue.IMessageNodeV2, channel ...string) *mqueue.QueueMessage {
+		t.Helper()
+		message, err := node.Get(ctx, channel...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		node, _ := setup(t)
+		if _, err := node.Add(ctx, mqueue.Message{Message: "x"}); !errors.Is(err, mqueue.ErrInvalidMessage) {
+			t.Error("expect ErrInvalidMessage")
+		}
+		if err := node.Ack(ctx, "none"); !errors.Is(err, mqueue.ErrNotFound) {
+			t.Error("expect ErrNotFound")
+		}
+	})
+
+	t.Run("AddGetAck", func(t *testing.T) {
+		node, _ := setup(t)
+		ids, err := node.Add(ctx, mqueue.Message{Channel: "a", Message: "hello", MaxTries: 3}, mqueue.Message{Channel: "b", Message: int32(1), MaxTries: 3})
+		if err != nil || len(ids) != 2 {
+			t.Fatal(ids, err)
+		}
+		message := get(t, node, "a")
+		if message.ID.Hex() != ids[0] || message.Message != "hello" || message.Tries != 1 {
+			t.Error("message error", message)
+		}
+		count(t, node.Size, 0)
+		count(t, node.InFlight, 1)
+		empty(t, node, "a")
+
+		if err := node.Ack(ctx, message.Ack); err != nil {
+			t.Error(err)
+		}
+		if err := node.Ack(ctx, message.Ack); !errors.Is(err, mqueue.ErrNotFound) {
+			t.Error("expect ErrNotFound")
+		}
+		count(t, node.Done, 1)
+		count(t, node.InFlight, 0)
+		count(t, node.Total, 1)
+	})
+
+	t.Run("Payload", func(t *testing.T) {
+		node, _ := setup(t)
+		type payload struct {
+			Name string
+			N    int
+		}
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: payload{Name: "x", N: 2}, MaxTries: 1})
+		var got payload
+		if !get(t, node).MessageDecode(&got) || got.Name != "x" || got.N != 2 {
+			t.Error("decode error", got)
+		}
+	})
+
+	t.Run("Visibility", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 3})
+		first := get(t, node)
+		clock.Advance(testVisibility)
+		second := get(t, node)
+		if second.ID != first.ID || second.Tries != 2 || second.Ack == first.Ack {
+			t.Error("redelivery error", second)
+		}
+		if err := node.Ack(ctx, first.Ack); !errors.Is(err, mqueue.ErrNotFound) {
+			t.Error("old ack should be invalid")
+		}
+		clock.Advance(testVisibility)
+		if err := node.Ack(ctx, second.Ack); !errors.Is(err, mqueue.ErrNotFound) {
+			t.Error("expired lease should not be acked")
+		}
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 3})
+		message := get(t, node)
+		clock.Advance(testVisibility - time.Second)
+		if err := node.Ping(ctx, message.Ack); err != nil {
+			t.Error(err)
+		}
+		clock.Advance(2 * time.Second)
+		empty(t, node)
+		if err := node.Ack(ctx, message.Ack); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("MessageVisibility", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 3, Visibility: time.Hour})
+		message := get(t, node)
+		clock.Advance(testVisibility)
+		empty(t, node)
+		clock.Advance(time.Hour - testVisibility - time.Second)
+		if err := node.Ping(ctx, message.Ack, 10*time.Second); err != nil {
+			t.Error(err)
+		}
+		clock.Advance(5 * time.Second)
+		empty(t, node)
+		clock.Advance(5 * time.Second)
+		if get(t, node).ID != message.ID {
+			t.Error("expect redelivery after extension")
+		}
+	})
+
+	t.Run("Undecodable", func(t *testing.T) {
+		node, _ := setup(t)
+		// 使用已删除的密钥加密的消息
+		envelope := bson.D{{Key: "_mqcodec", Value: 1}, {Key: "key_id", Value: "removed"}, {Key: "data", Value: []byte("x")}}
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: envelope, MaxTries: 3}, mqueue.Message{Channel: "a", Message: "ok", MaxTries: 3})
+		if message := get(t, node); message.Message != "ok" {
+			t.Error("expect next message", message)
+		}
+		count(t, node.Dead, 1)
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 3, Delay: 10 * time.Second})
+		empty(t, node)
+		count(t, node.InFlight, 1)
+		clock.Advance(10 * time.Second)
+		get(t, node)
+	})
+
+	t.Run("Nack", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 2})
+		message := get(t, node)
+		if err := node.Nack(ctx, message.Ack, mqueue.NackOpts{Delay: 5 * time.Second, Error: "fail"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := node.Ack(ctx, message.Ack); !errors.Is(err, mqueue.ErrNotFound) {
+			t.Error("old ack should be invalid")
+		}
+		empty(t, node)
+		clock.Advance(5 * time.Second)
+		message = get(t, node)
+		if message.Tries != 2 || message.LastError != "fail" {
+			t.Error("retry error", message)
+		}
+		// 已达到最大投递次数
+		if err := node.Nack(ctx, message.Ack, mqueue.NackOpts{}); err != nil {
+			t.Fatal(err)
+		}
+		count(t, node.Dead, 1)
+		count(t, node.Done, 1)
+		clock.Advance(time.Hour)
+		empty(t, node)
+	})
+
+	t.Run("MaxTries", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 1})
+		get(t, node)
+		clock.Advance(testVisibility)
+		empty(t, node)
+		count(t, node.Dead, 1)
+		count(t, node.Size, 0)
+	})
+
+	t.Run("Priority", func(t *testing.T) {
+		node, _ := setup(t)
+		node.Add(ctx,
+			mqueue.Message{Channel: "a", Message: "low", MaxTries: 1},
+			mqueue.Message{Channel: "a", Message: "high", MaxTries: 1, Priority: 10},
+		)
+		if message := get(t, node); message.Message != "high" {
+			t.Error("priority error", message.Message)
+		}
+	})
+
+	t.Run("Group", func(t *testing.T) {
+		node, _ := setup(t)
+		node.Add(ctx,
+			mqueue.Message{Channel: "a", Message: "1", MaxTries: 1, GroupKey: "g"},
+			mqueue.Message{Channel: "a", Message: "2", MaxTries: 1, GroupKey: "g", Priority: 10},
+		)
+		first := get(t, node)
+		if first.Message != "1" {
+			t.Error("group order error", first.Message)
+		}
+		empty(t, node)
+		node.Ack(ctx, first.Ack)
+		if message := get(t, node); message.Message != "2" {
+			t.Error("group order error", message.Message)
+		}
+	})
+
+	t.Run("GroupRedelivery", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx,
+			mqueue.Message{Channel: "a", Message: "1", MaxTries: 2, GroupKey: "g"},
+			mqueue.Message{Channel: "a", Message: "2", MaxTries: 1, GroupKey: "g"},
+		)
+		first := get(t, node)
+		node.Nack(ctx, first.Ack, mqueue.NackOpts{Delay: time.Second})
+		// 重新投递的队首可见时间晚于后面的消息
+		clock.Advance(time.Second)
+		if message := get(t, node); message.Message != "1" {
+			t.Error("redelivered head error", message.Message)
+		}
+		empty(t, node)
+	})
+
+	t.Run("Dedup", func(t *testing.T) {
+		node, clock := setup(t)
+		first, err := node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 1, DedupKey: "k"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 1, DedupKey: "k"})
+		if err != nil || second[0] != first[0] {
+			t.Error("dedup error", second, err)
+		}
+		count(t, node.Total, 1)
+		clock.Advance(mqueue.DefaultDedupWindow)
+		third, err := node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 1, DedupKey: "k"})
+		if err != nil || third[0] == first[0] {
+			t.Error("dedup window error", third, err)
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		node, clock := setup(t)
+		if _, err := node.GetBatch(ctx, "a", 10); !errors.Is(err, mqueue.ErrEmpty) {
+			t.Error("expect ErrEmpty", err)
+		}
+		node.Add(ctx,
+			mqueue.Message{Channel: "a", Message: "1", MaxTries: 2},
+			mqueue.Message{Channel: "a", Message: "2", MaxTries: 2, Priority: 10},
+			mqueue.Message{Channel: "a", Message: "3", MaxTries: 2, GroupKey: "g"},
+			mqueue.Message{Channel: "a", Message: "4", MaxTries: 2, GroupKey: "g"},
+			mqueue.Message{Channel: "b", Message: "5", MaxTries: 2},
+		)
+		messages, err := node.GetBatch(ctx, "a", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 同一分组只返回队首
+		if len(messages) != 3 || messages[0].Message != "2" {
+			t.Fatal("batch error", len(messages))
+		}
+		acks := make(map[any]string)
+		for _, message := range messages {
+			if message.Tries != 1 || acks[message.Message] != "" {
+				t.Error("lease error", message)
+			}
+			acks[message.Message] = message.Ack
+		}
+		count(t, node.InFlight, 3)
+
+		// 分组中的 "3" 仍在处理中, 租约过期后重新投递的是它而不是 "4"
+		acked, err := node.AckBatch(ctx, []string{acks["1"], acks["2"], "none"})
+		if err != nil || acked != 2 {
+			t.Error("ack batch error", acked, err)
+		}
+		count(t, node.Done, 2)
+
+		clock.Advance(testVisibility)
+		messages, err = node.GetBatch(ctx, "a", 1)
+		if err != nil || len(messages) != 1 || messages[0].Message != "3" || messages[0].Tries != 2 {
+			t.Error("redelivery error", messages, err)
+		}
+	})
+
+	t.Run("BatchDead", func(t *testing.T) {
+		node, clock := setup(t)
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "expired", MaxTries: 1})
+		get(t, node)
+		clock.Advance(testVisibility)
+		envelope := bson.D{{Key: "_mqcodec", Value: 1}, {Key: "key_id", Value: "removed"}, {Key: "data", Value: []byte("x")}}
+		node.Add(ctx,
+			mqueue.Message{Channel: "a", Message: envelope, MaxTries: 3, Priority: 10},
+			mqueue.Message{Channel: "a", Message: "1", MaxTries: 3},
+			mqueue.Message{Channel: "a", Message: "2", MaxTries: 3},
+		)
+		// 超过重试次数和无法解码的消息进入死信, 其余消息正常返回
+		messages, err := node.GetBatch(ctx, "a", 10)
+		if err != nil || len(messages) != 2 {
+			t.Fatal("batch error", len(messages), err)
+		}
+		count(t, node.Dead, 2)
+		count(t, node.InFlight, 2)
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		node, _ := setup(t)
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		c := node.Watch(ctx, 50*time.Millisecond, "a")
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 1})
+		if message := <-c; message == nil || message.Message != "x" {
+			t.Error("watch error", message)
+		}
+		cancel()
+		for range c {
+		}
+	})
+}
+
+func TestMessageNodeV1(t *testing.T) {
+	node := mqueue.NewMessageNodeV1(mqueue.NewMemoryNode(mqueue.MemoryOpts{}))
+	if !node.Add(mqueue.Message{Channel: "a", Message: "x", MaxTries: 1}) {
+		t.Fatal("add error")
+	}
+	message, ok := node.Get()
+	if !ok || !node.Ack(message.Ack) {
+		t.Error("get/ack error")
+	}
+	if _, ok := node.Get(); ok {
+		t.Error("expect empty")
+	}
+}
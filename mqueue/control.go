@@ -0,0 +1,263 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/sliceutils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 本地缓存 channel 设置的时间, 暂停和限流在其他实例上最多延迟这么久生效
+const controlCacheTTL = time.Second
+
+// ChannelControl 保存在 "<集合名>_channels" 中, 对所有实例生效
+type ChannelControl struct {
+	Channel string `bson:"_id"     json:"channel"`
+	Paused  bool   `bson:"paused"  json:"paused"`
+	// 每个 RateInterval 内最多投递 RateLimit 次, 为 0 时不限制
+	RateLimit    int           `bson:"rate_limit"    json:"rate_limit"`
+	RateInterval time.Duration `bson:"rate_interval" json:"rate_interval"`
+	// 当前限流窗口的开始时间和已投递次数
+	WindowStart time.Time `bson:"window_start" json:"window_start"`
+	WindowCount int       `bson:"window_count" json:"window_count"`
+	Updated     time.Time `bson:"updated"      json:"updated"`
+}
+
+func (c *ChannelControl) limited() bool {
+	return c.RateLimit > 0 && c.RateInterval > 0
+}
+
+// exhaustedUntil 当前窗口的次数已用完时返回窗口结束时间
+func (c *ChannelControl) exhaustedUntil(now time.Time) time.Time {
+	if !c.limited() || c.WindowCount < c.RateLimit {
+		return time.Time{}
+	}
+	if end := c.WindowStart.Add(c.RateInterval); end.After(now) {
+		return end
+	}
+	return time.Time{}
+}
+
+type controlCache struct {
+	mu        sync.Mutex
+	loaded    time.Time
+	controls  map[string]*ChannelControl
+	exhausted map[string]time.Time // 限流次数用完的 channel 到窗口结束的时间
+}
+
+func newControlCache() *controlCache {
+	return &controlCache{}
+}
+
+func (c *controlCache) get(now time.Time) (map[string]*ChannelControl, map[string]time.Time, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.controls == nil || now.Sub(c.loaded) > controlCacheTTL {
+		return nil, nil, false
+	}
+	exhausted := make(map[string]time.Time, len(c.exhausted))
+	for channel, until := range c.exhausted {
+		exhausted[channel] = until
+	}
+	return c.controls, exhausted, true
+}
+
+func (c *controlCache) set(now time.Time, controls map[string]*ChannelControl, exhausted map[string]time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loaded = now
+	c.controls = controls
+	c.exhausted = make(map[string]time.Time, len(exhausted))
+	for channel, until := range exhausted {
+		c.exhausted[channel] = until
+	}
+}
+
+func (c *controlCache) exhaust(channel string, until time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.exhausted != nil {
+		c.exhausted[channel] = until
+	}
+}
+
+func (c *controlCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controls = nil
+}
+
+func (n *MessageNodeV2) controls() *mongo.Collection {
+	return n.node.sibling("channels")
+}
+
+// Pause 暂停后 Get/Watch/Worker 不再获取这个 channel 的消息, 处理中的消息不受影响
+func (n *MessageNodeV2) Pause(ctx context.Context, channel string) error {
+	return n.setControl(ctx, channel, bson.M{"paused": true})
+}
+
+// Resume
+func (n *MessageNodeV2) Resume(ctx context.Context, channel string) error {
+	return n.setControl(ctx, channel, bson.M{"paused": false})
+}
+
+// SetRateLimit 限制 channel 每个 interval 内最多投递 limit 次 (包括重试), 所有实例共享; limit 为 0 时取消限制
+func (n *MessageNodeV2) SetRateLimit(ctx context.Context, channel string, limit int, interval time.Duration) error {
+	if limit < 0 || (limit > 0 && interval <= 0) {
+		return ErrInvalidMessage
+	}
+	return n.setControl(ctx, channel, bson.M{"rate_limit": limit, "rate_interval": interval})
+}
+
+func (n *MessageNodeV2) setControl(ctx context.Context, channel string, set bson.M) error {
+	if channel == "" {
+		return ErrInvalidMessage
+	}
+	set["updated"] = n.node.now()
+	_, err := n.controls().UpdateOne(ctx, bson.M{"_id": channel}, bson.M{"$set": set}, options.Update().SetUpsert(true))
+	n.node.controls.invalidate()
+	return err
+}
+
+// Controls 所有设置过的 channel
+func (n *MessageNodeV2) Controls(ctx context.Context) ([]*ChannelControl, error) {
+	result := make([]*ChannelControl, 0)
+	cursor, err := n.controls().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// channelControls 带缓存的 channel 设置, 以及限流次数已用完的 channel
+func (n *MessageNodeV2) channelControls(ctx context.Context) (map[string]*ChannelControl, map[string]time.Time, error) {
+	now := n.node.now()
+	if controls, exhausted, ok := n.node.controls.get(now); ok {
+		return controls, exhausted, nil
+	}
+	list, err := n.Controls(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	controls := make(map[string]*ChannelControl, len(list))
+	exhausted := make(map[string]time.Time)
+	for _, c := range list {
+		controls[c.Channel] = c
+		if until := c.exhaustedUntil(now); !until.IsZero() {
+			exhausted[c.Channel] = until
+		}
+	}
+	n.node.controls.set(now, controls, exhausted)
+	return controls, exhausted, nil
+}
+
+// readyQuery 可获取的消息, 排除暂停和限流次数已用完的 channel; 指定的 channel 全部被排除时返回 ErrEmpty
+func readyQuery(now time.Time, channel []string, controls map[string]*ChannelControl, exhausted map[string]time.Time) (bson.M, error) {
+	query := bson.M{"visible": bson.M{"$lte": now}, "dead": false, "deleted": nil}
+	excluded := make([]string, 0)
+	for _, c := range controls {
+		if c.Paused || exhausted[c.Channel].After(now) {
+			excluded = append(excluded, c.Channel)
+		}
+	}
+	if len(excluded) == 0 {
+		return byChannel(query, channel), nil
+	}
+	if len(channel) == 0 {
+		query["channel"] = bson.M{"$nin": excluded}
+		return query, nil
+	}
+	allowed := sliceutils.Filter(channel, func(item string) bool {
+		return !sliceutils.Contains(excluded, item)
+	})
+	if len(allowed) == 0 {
+		return nil, ErrEmpty
+	}
+	return byChannel(query, allowed), nil
+}
+
+// acquire 在限流窗口内占用一次投递, 返回所在窗口的开始时间; 次数已用完时返回 false
+func (n *MessageNodeV2) acquire(ctx context.Context, c *ChannelControl) (time.Time, bool, error) {
+	now := n.node.now()
+	after := options.After
+	opts := &options.FindOneAndUpdateOptions{ReturnDocument: &after}
+	control := new(ChannelControl)
+
+	// 当前窗口还有余量
+	err := n.controls().FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":          c.Channel,
+			"window_start": bson.M{"$gt": now.Add(-c.RateInterval)},
+			"window_count": bson.M{"$lt": c.RateLimit},
+		},
+		bson.M{"$inc": bson.M{"window_count": 1}},
+		opts,
+	).Decode(control)
+	if err == nil {
+		return control.WindowStart, true, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, false, err
+	}
+
+	// 窗口已过期, 只有一个实例能开启新窗口
+	err = n.controls().FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id": c.Channel,
+			"$or": bson.A{
+				bson.M{"window_start": bson.M{"$lte": now.Add(-c.RateInterval)}},
+				bson.M{"window_start": nil},
+			},
+		},
+		bson.M{"$set": bson.M{"window_start": now, "window_count": 1}},
+		opts,
+	).Decode(control)
+	if err == nil {
+		return control.WindowStart, true, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, false, err
+	}
+
+	// 次数已用完, 在窗口结束前不再查询这个 channel
+	if err := n.controls().FindOne(ctx, bson.M{"_id": c.Channel}).Decode(control); err == nil {
+		control.RateLimit, control.RateInterval = c.RateLimit, c.RateInterval
+		if until := control.exhaustedUntil(now); !until.IsZero() {
+			n.node.controls.exhaust(c.Channel, until)
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// release 消息没有获取成功时归还占用的次数
+func (n *MessageNodeV2) release(ctx context.Context, channel string, window time.Time) error {
+	_, err := n.controls().UpdateOne(
+		ctx,
+		bson.M{"_id": channel, "window_start": window, "window_count": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"window_count": -1}},
+	)
+	return err
+}
@@ -0,0 +1,138 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/sliceutils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestExhaustedUntil(t *testing.T) {
+	now := time.Now()
+	start := now.Add(-30 * time.Second)
+	for _, item := range []struct {
+		control ChannelControl
+		want    time.Time
+	}{
+		{ChannelControl{WindowStart: start, WindowCount: 10}, time.Time{}},
+		{ChannelControl{RateLimit: 2, RateInterval: time.Minute, WindowStart: start, WindowCount: 1}, time.Time{}},
+		{ChannelControl{RateLimit: 2, RateInterval: time.Minute, WindowStart: start, WindowCount: 2}, start.Add(time.Minute)},
+		// 窗口已结束
+		{ChannelControl{RateLimit: 2, RateInterval: 10 * time.Second, WindowStart: start, WindowCount: 2}, time.Time{}},
+	} {
+		if got := item.control.exhaustedUntil(now); !got.Equal(item.want) {
+			t.Error("exhaustedUntil error", item.control, got)
+		}
+	}
+}
+
+func TestReadyQuery(t *testing.T) {
+	now := time.Now()
+	controls := map[string]*ChannelControl{
+		"paused":  {Channel: "paused", Paused: true},
+		"limited": {Channel: "limited", RateLimit: 1, RateInterval: time.Minute},
+		"expired": {Channel: "expired", RateLimit: 1, RateInterval: time.Minute},
+	}
+	exhausted := map[string]time.Time{
+		"limited": now.Add(time.Second),
+		"expired": now.Add(-time.Second),
+	}
+	base := func(channel any) bson.M {
+		query := bson.M{"visible": bson.M{"$lte": now}, "dead": false, "deleted": nil}
+		if channel != nil {
+			query["channel"] = channel
+		}
+		return query
+	}
+
+	query, err := readyQuery(now, []string{"a"}, nil, nil)
+	if err != nil || !reflect.DeepEqual(query, base("a")) {
+		t.Error("no controls", query, err)
+	}
+	query, err = readyQuery(now, nil, controls, exhausted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded := query["channel"].(bson.M)["$nin"].([]string)
+	if len(excluded) != 2 || !sliceutils.Contains(excluded, "paused") || !sliceutils.Contains(excluded, "limited") {
+		t.Error("excluded error", excluded)
+	}
+	query, err = readyQuery(now, []string{"a", "paused", "expired"}, controls, exhausted)
+	if err != nil || !reflect.DeepEqual(query, base(bson.M{"$in": []string{"a", "expired"}})) {
+		t.Error("allowed error", query, err)
+	}
+	if _, err := readyQuery(now, []string{"paused", "limited"}, controls, exhausted); !errors.Is(err, ErrEmpty) {
+		t.Error("expect ErrEmpty", err)
+	}
+}
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoChannelControl(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	clock := NewManualClock(time.Now().Truncate(time.Millisecond))
+	mq, err := NewMQueueE(QueueOpts{
+		Mode:  DebugMode,
+		DB:    DBConfig{URI: uri, Database: "mqueue_test", Collection: "control_" + primitive.NewObjectID().Hex()},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close(ctx)
+	defer mq.MessageV2.controls().Drop(ctx)
+	defer mq.MessageV2.Clear(ctx)
+	node := mq.MessageV2
+
+	t.Run("Pause", func(t *testing.T) {
+		node.Add(ctx, Message{Channel: "a", Message: "a", MaxTries: 1}, Message{Channel: "b", Message: "b", MaxTries: 1})
+		if err := node.Pause(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := node.Get(ctx, "a"); !errors.Is(err, ErrEmpty) {
+			t.Error("paused channel should be empty", err)
+		}
+		if message, err := node.Get(ctx); err != nil || message.Channel != "b" {
+			t.Error("expect other channel", message, err)
+		}
+		node.Resume(ctx, "a")
+		if _, err := node.Get(ctx, "a"); err != nil {
+			t.Error("resume error", err)
+		}
+	})
+
+	t.Run("RateLimit", func(t *testing.T) {
+		if err := node.SetRateLimit(ctx, "c", 2, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			node.Add(ctx, Message{Channel: "c", Message: i, MaxTries: 1})
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := node.Get(ctx, "c"); err != nil {
+				t.Fatal("within limit", i, err)
+			}
+		}
+		if _, err := node.Get(ctx, "c"); !errors.Is(err, ErrEmpty) {
+			t.Error("limit exceeded", err)
+		}
+		// 其他实例在缓存过期后也能看到用完的窗口
+		clock.Advance(controlCacheTTL + time.Millisecond)
+		if _, err := node.Get(ctx, "c"); !errors.Is(err, ErrEmpty) {
+			t.Error("limit exceeded after cache reload", err)
+		}
+		clock.Advance(time.Minute)
+		if _, err := node.Get(ctx, "c"); err != nil {
+			t.Error("new window", err)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package mqueue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "*/5 0-6 1,15 * 1-5", "@daily", "0 0 * * 7"} {
+		if _, err := mqueue.ParseCron(expr); err != nil {
+			t.Error(expr, err)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := mqueue.ParseCron(expr); err == nil {
+			t.Error("expect error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	base := time.Date(2024, 1, 31, 23, 58, 30, 0, time.UTC)
+	cases := map[string]time.Time{
+		"* * * * *":    time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC),
+		"*/15 * * * *": time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"30 9 * * *":   time.Date(2024, 2, 1, 9, 30, 0, 0, time.UTC),
+		"0 0 29 2 *":   time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 12 * * 0":   time.Date(2024, 2, 4, 12, 0, 0, 0, time.UTC),
+		"0 12 * * 7":   time.Date(2024, 2, 4, 12, 0, 0, 0, time.UTC),
+		"0 0 15 * 1":   time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC),
+		"@monthly":     time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for expr, want := range cases {
+		cron, err := mqueue.ParseCron(expr)
+		if err != nil {
+			t.Error(expr, err)
+			continue
+		}
+		if got := cron.Next(base); !got.Equal(want) {
+			t.Error(expr, got, want)
+		}
+	}
+
+	cron, _ := mqueue.ParseCron("0 0 30 2 *")
+	if !cron.Next(base).IsZero() {
+		t.Error("expect never fires")
+	}
+}
@@ -14,22 +14,23 @@ type DBConfig struct {
 	Collection string
 }
 
-func connect(config DBConfig) *mongo.Database {
+func connect(config DBConfig) (*mongo.Database, error) {
 	clientOptions := options.Client().ApplyURI(config.URI)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// 检查连接
 	err = client.Ping(ctx, nil)
 	if err != nil {
-		panic(err)
+		client.Disconnect(context.Background())
+		return nil, err
 	}
 
 	// 选择数据库
-	return client.Database(config.Database)
+	return client.Database(config.Database), nil
 }
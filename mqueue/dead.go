@@ -0,0 +1,179 @@
+package mqueue
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 每条消息保留的失败记录条数
+const maxFailures = 10
+
+type Failure struct {
+	Tries int       `bson:"tries" json:"tries"`
+	Error string    `bson:"error" json:"error"`
+	At    time.Time `bson:"at"    json:"at"`
+}
+
+// DeadMessage 死信, Deleted 为标记为死信的时间
+type DeadMessage struct {
+	QueueMessage `bson:",inline"`
+	Failures     []Failure `bson:"failures"`
+	Deleted      time.Time `bson:"deleted"`
+}
+
+func deadQuery(channel []string) bson.M {
+	return byChannel(bson.M{"dead": true}, channel)
+}
+
+// DeadList 分页列出死信, page 从 1 开始
+func (n *MessageNodeV2) DeadList(ctx context.Context, page int64, size int64, channel ...string) ([]*DeadMessage, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	result := make([]*DeadMessage, 0, size)
+	query := deadQuery(channel)
+	cursor, err := n.node.coll.Find(
+		ctx,
+		query,
+		options.Find().SetSort(bson.D{{Key: "deleted", Value: -1}}).SetSkip((page-1)*size).SetLimit(size),
+	)
+	if err != nil {
+		return result, 0, err
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &result); err != nil {
+		return result, 0, err
+	}
+	for _, item := range result {
+		n.decodeForView(&item.QueueMessage)
+	}
+
+	count, err := n.node.coll.CountDocuments(ctx, query)
+	if err != nil {
+		return result, 0, err
+	}
+	return result, count, nil
+}
+
+// requeueUpdate 重置投递次数并立即可见
+func requeueUpdate(now time.Time) bson.M {
+	return bson.M{
+		"$set":   bson.M{"dead": false, "tries": 0, "ack": id(), "visible": now},
+		"$unset": bson.M{"deleted": "", "dead_at": ""},
+	}
+}
+
+// Requeue 将一条死信重新放回队列
+func (n *MessageNodeV2) Requeue(ctx context.Context, messageID string) error {
+	oid, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return err
+	}
+	res, err := n.node.coll.UpdateOne(ctx, bson.M{"_id": oid, "dead": true}, requeueUpdate(n.node.now()))
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RequeueAll 将死信全部放回队列, 返回数量
+func (n *MessageNodeV2) RequeueAll(ctx context.Context, channel ...string) (int64, error) {
+	// ack 需要唯一, 不能用 UpdateMany 设置同一个值
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"dead":    false,
+			"tries":   0,
+			"ack":     bson.M{"$concat": bson.A{id(), "-", bson.M{"$toString": "$_id"}}},
+			"visible": n.node.now(),
+		}}},
+		{{Key: "$unset", Value: bson.A{"deleted", "dead_at"}}},
+	}
+	res, err := n.node.coll.UpdateMany(ctx, deadQuery(channel), update)
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// MoveDead 将死信移动到单独的集合, collection 为空时使用 "<集合名>_dlq".
+// 写入目标集合失败的死信保留在原集合, 返回写入的错误
+func (n *MessageNodeV2) MoveDead(ctx context.Context, collection string, channel ...string) (int64, error) {
+	target := n.node.sibling("dlq")
+	if collection != "" {
+		target = n.node.coll.Database().Collection(collection)
+	}
+
+	cursor, err := n.node.coll.Find(ctx, deadQuery(channel))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var moved int64
+	docs := make([]interface{}, 0, 100)
+	ids := make([]any, 0, 100)
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		// 重复执行时忽略已经存在的文档, 只删除已经写入目标集合的死信
+		_, insertErr := target.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		written := ids
+		if insertErr != nil {
+			failed, err := failedInserts(insertErr)
+			if err != nil {
+				return err
+			}
+			if len(failed) == 0 {
+				insertErr = nil
+			}
+			written = make([]any, 0, len(ids))
+			for i, id := range ids {
+				if !failed[i] {
+					written = append(written, id)
+				}
+			}
+		}
+		if len(written) > 0 {
+			res, err := n.node.coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": written}})
+			if err != nil {
+				return err
+			}
+			moved += res.DeletedCount
+		}
+		docs = docs[:0]
+		ids = ids[:0]
+		return insertErr
+	}
+	for cursor.Next(ctx) {
+		doc := bson.Raw(append([]byte(nil), cursor.Current...))
+		docs = append(docs, doc)
+		ids = append(ids, doc.Lookup("_id"))
+		if len(docs) == cap(docs) {
+			if err := flush(); err != nil {
+				return moved, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return moved, err
+	}
+	return moved, flush()
+}
+
+// PurgeDead 删除死信, 返回数量
+func (n *MessageNodeV2) PurgeDead(ctx context.Context, channel ...string) (int64, error) {
+	res, err := n.node.coll.DeleteMany(ctx, deadQuery(channel))
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
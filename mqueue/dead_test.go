@@ -0,0 +1,157 @@
+package mqueue_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoDead(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database("mqueue_test")
+
+	setup := func(t *testing.T) (*mqueue.MessageNodeV2, string) {
+		name := "dead_" + primitive.NewObjectID().Hex()
+		mq, err := mqueue.NewMQueueWithDatabaseE(db, mqueue.QueueOpts{
+			Mode: mqueue.DebugMode,
+			DB:   mqueue.DBConfig{Collection: name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			mq.MessageV2.Clear(ctx)
+			db.Collection(name + "_dlq").Drop(ctx)
+		})
+		return mq.MessageV2, name
+	}
+	// kill 写入一条消息并使它进入死信
+	kill := func(t *testing.T, node *mqueue.MessageNodeV2, channel string) string {
+		ids, err := node.Add(ctx, mqueue.Message{Channel: channel, Message: channel, MaxTries: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := node.Get(ctx, channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := node.Nack(ctx, message.Ack, mqueue.NackOpts{Error: "fail"}); err != nil {
+			t.Fatal(err)
+		}
+		return ids[0]
+	}
+	dead := func(node *mqueue.MessageNodeV2, channel ...string) int64 {
+		n, _ := node.Dead(ctx, channel...)
+		return n
+	}
+
+	t.Run("Requeue", func(t *testing.T) {
+		node, _ := setup(t)
+		id := kill(t, node, "a")
+		if err := node.Requeue(ctx, primitive.NewObjectID().Hex()); !errors.Is(err, mqueue.ErrNotFound) {
+			t.Error("expect ErrNotFound", err)
+		}
+		if err := node.Requeue(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		message, err := node.Get(ctx, "a")
+		if err != nil || message.ID.Hex() != id || message.Tries != 1 {
+			t.Error("requeued message error", message, err)
+		}
+		if dead(node) != 0 {
+			t.Error("dead count error")
+		}
+	})
+
+	t.Run("RequeueAll", func(t *testing.T) {
+		node, _ := setup(t)
+		kill(t, node, "a")
+		kill(t, node, "a")
+		kill(t, node, "b")
+		if n, err := node.RequeueAll(ctx, "a"); err != nil || n != 2 {
+			t.Error("requeue all error", n, err)
+		}
+		if dead(node, "a") != 0 || dead(node, "b") != 1 {
+			t.Error("dead count error")
+		}
+		// ack 各不相同, 可以分别取出
+		first, _ := node.Get(ctx, "a")
+		second, _ := node.Get(ctx, "a")
+		if first == nil || second == nil || first.Ack == second.Ack {
+			t.Error("requeued ack error", first, second)
+		}
+	})
+
+	t.Run("MoveDead", func(t *testing.T) {
+		node, name := setup(t)
+		id := kill(t, node, "a")
+		kill(t, node, "b")
+		// 重复执行时已存在的文档算作已移动
+		oid, _ := primitive.ObjectIDFromHex(id)
+		if _, err := db.Collection(name+"_dlq").InsertOne(ctx, bson.M{"_id": oid}); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := node.MoveDead(ctx, ""); err != nil || n != 2 {
+			t.Error("move error", n, err)
+		}
+		if dead(node) != 0 {
+			t.Error("dead count error")
+		}
+		if n, _ := db.Collection(name+"_dlq").CountDocuments(ctx, bson.M{}); n != 2 {
+			t.Error("dlq count error", n)
+		}
+	})
+
+	t.Run("MoveDeadPartial", func(t *testing.T) {
+		node, name := setup(t)
+		kill(t, node, "a")
+		kill(t, node, "b")
+		// 目标集合拒绝 channel b 的文档, 写入失败的死信保留在原集合
+		target := name + "_rejected"
+		err := db.CreateCollection(ctx, target, options.CreateCollection().SetValidator(bson.M{"channel": bson.M{"$ne": "b"}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Collection(target).Drop(ctx)
+		n, err := node.MoveDead(ctx, target)
+		if err == nil || n != 1 {
+			t.Error("partial move error", n, err)
+		}
+		if dead(node, "a") != 0 || dead(node, "b") != 1 {
+			t.Error("dead count error")
+		}
+	})
+
+	t.Run("PurgeDead", func(t *testing.T) {
+		node, _ := setup(t)
+		kill(t, node, "a")
+		kill(t, node, "b")
+		node.Add(ctx, mqueue.Message{Channel: "a", Message: "alive", MaxTries: 1})
+		if n, err := node.PurgeDead(ctx, "a"); err != nil || n != 1 {
+			t.Error("purge error", n, err)
+		}
+		if dead(node) != 1 {
+			t.Error("dead count error")
+		}
+		if n, _ := node.Size(ctx, "a"); n != 1 {
+			t.Error("purged live message", n)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 并发情况下释放过期去重键后重新写入的最大次数
+const maxDedupRetries = 3
+
+func isDuplicateKey(code int) bool {
+	return code == 11000 || code == 11001 || code == 12582
+}
+
+// failedInserts 无序 InsertMany 中因重复键以外的原因写入失败的文档下标, 重复键视为已经写入.
+// err 不是 BulkWriteException 或有写关注错误时无法确定写入结果, 返回 err
+func failedInserts(err error) (map[int]bool, error) {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return nil, err
+	}
+	failed := make(map[int]bool)
+	for _, we := range bwe.WriteErrors {
+		if !isDuplicateKey(we.Code) {
+			failed[we.Index] = true
+		}
+	}
+	return failed, nil
+}
+
+// duplicated 查找窗口期内去重键相同的消息并返回它的 ID, 已过期的去重键会被释放
+func (n *MessageNodeV2) duplicated(ctx context.Context, doc bson.M) (string, error) {
+	var existing struct {
+		ID      primitive.ObjectID `bson:"_id"`
+		Created time.Time          `bson:"created"`
+	}
+	err := n.node.coll.FindOne(ctx, bson.M{"channel": doc["channel"], "dedup_key": doc["dedup_key"]}).Decode(&existing)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", nil
+		}
+		return "", err
+	}
+	if existing.Created.Add(n.node.dedupWindow).After(n.node.now()) {
+		return existing.ID.Hex(), nil
+	}
+	_, err = n.node.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": existing.ID, "dedup_key": doc["dedup_key"]},
+		bson.M{"$unset": bson.M{"dedup_key": ""}},
+	)
+	return "", err
+}
+
+// dedup 处理去重键冲突: 已存在的消息仍在窗口期内时返回它的 ID, 否则重新写入
+func (n *MessageNodeV2) dedup(ctx context.Context, doc bson.M) (string, error) {
+	for i := 0; i < maxDedupRetries; i++ {
+		existing, err := n.duplicated(ctx, doc)
+		if err != nil {
+			return "", err
+		}
+		if existing != "" {
+			return existing, nil
+		}
+
+		_, err = n.node.coll.InsertOne(ctx, doc)
+		if err == nil {
+			return doc["_id"].(primitive.ObjectID).Hex(), nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return "", err
+		}
+	}
+	return "", ErrDuplicate
+}
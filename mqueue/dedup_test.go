@@ -0,0 +1,71 @@
+package mqueue_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行, 需要副本集
+func TestMongoTransactionalDedup(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	mq, err := mqueue.NewMQueueWithDatabaseE(client.Database("mqueue_test"), mqueue.QueueOpts{
+		Mode: mqueue.DebugMode,
+		DB:   mqueue.DBConfig{Collection: "txn_" + primitive.NewObjectID().Hex()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.MessageV2.Clear(ctx)
+	node := mq.MessageV2
+
+	add := func(message ...mqueue.Message) []string {
+		session, err := client.StartSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.EndSession(ctx)
+		ids, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			return node.Add(sc, message...)
+		})
+		if err != nil && strings.Contains(err.Error(), "replica set") {
+			t.Skip("transactions need a replica set")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids.([]string)
+	}
+
+	// 同一次调用中重复的去重键不会中止事务
+	ids := add(
+		mqueue.Message{Channel: "a", Message: "1", MaxTries: 1, DedupKey: "k"},
+		mqueue.Message{Channel: "a", Message: "2", MaxTries: 1, DedupKey: "k"},
+		mqueue.Message{Channel: "a", Message: "3", MaxTries: 1},
+	)
+	if len(ids) != 3 || ids[0] != ids[1] || ids[0] == ids[2] {
+		t.Error("ids error", ids)
+	}
+	// 已提交的去重键返回已存在的消息 ID
+	if again := add(mqueue.Message{Channel: "a", Message: "4", MaxTries: 1, DedupKey: "k"}); again[0] != ids[0] {
+		t.Error("dedup error", again, ids)
+	}
+	if total, _ := node.Total(ctx, "a"); total != 2 {
+		t.Error("total error", total)
+	}
+}
@@ -0,0 +1,38 @@
+package mqueue
+
+import "errors"
+
+var (
+	// 队列中没有可获取的消息
+	ErrEmpty = errors.New("mqueue: queue is empty")
+	// 消息不存在或租约已过期
+	ErrNotFound = errors.New("mqueue: message not found or lease expired")
+	// channel 或 message 为空
+	ErrInvalidMessage = errors.New("mqueue: invalid message")
+	// 去重键冲突且无法确定已存在的消息
+	ErrDuplicate = errors.New("mqueue: duplicate dedup key")
+	// 定时任务缺少必要字段, 或 Cron 和 Interval 没有且只有一个
+	ErrInvalidSchedule = errors.New("mqueue: invalid schedule")
+	// 消息不是通过 Call 发出的, 无法回复
+	ErrNoReplyTo = errors.New("mqueue: message has no correlation id")
+	// Call 在超时前没有收到回复
+	ErrCallTimeout = errors.New("mqueue: call timeout")
+	// 消费者通过 ReplyError 返回的错误
+	ErrRemote = errors.New("mqueue: remote error")
+	// 队列使用的索引不存在
+	ErrMissingIndex = errors.New("mqueue: missing index")
+	// 不支持的消息状态
+	ErrInvalidState = errors.New("mqueue: invalid message state")
+	// 仅允许在 debug 模式下调用
+	ErrDebugOnly = errors.New("mqueue: only available in debug mode")
+	// 没有为消息所在的 channel 注册处理函数
+	ErrNoHandler = errors.New("mqueue: no handler registered for channel")
+	// 处理成功但 Ack 失败 (租约已过期或消息已被处理)
+	ErrAckFailed = errors.New("mqueue: ack failed")
+	// 处理期间续租失败, 消息可能已被重新投递
+	ErrLeaseLost = errors.New("mqueue: lease lost")
+	// CodecOpts 配置错误
+	ErrInvalidCodec = errors.New("mqueue: invalid codec options")
+	// 解密消息所需的密钥不在 CodecOpts.Keys 中
+	ErrUnknownKey = errors.New("mqueue: unknown encryption key")
+)
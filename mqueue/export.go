@@ -0,0 +1,242 @@
+package mqueue
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 导入时一行最大的字节数, 与 MongoDB 文档大小上限一致并留出扩展 JSON 的开销
+const maxImportLine = 32 * 1024 * 1024
+
+// 导入和重放时每次写入的文档数
+const importBatchSize = 100
+
+type ExportOpts struct {
+	State   MessageState // 为空时不限制
+	Channel []string     // 为空时不限制
+	// 导出 "<集合名>_history" 中归档的消息, 此时 State 被忽略
+	History bool
+}
+
+// Export 按 _id 顺序将消息以 JSON Lines 格式写入 w, 每行为一条消息的完整文档 (canonical extended JSON),
+// 消息内容保持写入时的编码. 返回导出的数量
+func (n *MessageNodeV2) Export(ctx context.Context, w io.Writer, opts ExportOpts) (int64, error) {
+	coll := n.node.coll
+	query := bson.M{}
+	if opts.History {
+		coll = n.node.sibling("history")
+	} else {
+		var err error
+		if query, err = stateQuery(opts.State, n.node.now()); err != nil {
+			return 0, err
+		}
+	}
+	cursor, err := coll.Find(ctx, byChannel(query, opts.Channel), options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	bw := bufio.NewWriter(w)
+	var count int64
+	for cursor.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return count, err
+		}
+		if _, err := bw.Write(append(line, '\n')); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+type ImportOpts struct {
+	// 为 true 时未完成的消息立即可见, 否则保留原来的可见时间, 导出时处理中的消息在租约到期后重新投递
+	ResetDelay bool
+	// 不为空时导入到这个 channel
+	Channel string
+}
+
+// Import 导入 Export 的结果, 保留原消息的 _id, 已存在的消息 (相同 _id 或去重键) 被跳过, 可以重复执行.
+// 导入的消息会重新生成 ack, 原来的租约失效. 返回导入的数量
+func (n *MessageNodeV2) Import(ctx context.Context, r io.Reader, opts ImportOpts) (int64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+
+	var imported int64
+	docs := make([]interface{}, 0, importBatchSize)
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		count, err := n.insertIgnoreDuplicates(ctx, docs)
+		imported += count
+		docs = docs[:0]
+		return err
+	}
+
+	now := n.node.now()
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		// 使用 bson.D 保持字段顺序, 编码后的消息内容依赖第一个字段识别
+		doc := bson.D{}
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &doc); err != nil {
+			return imported, err
+		}
+		if field(doc, "_id") == nil || field(doc, "channel") == nil {
+			return imported, ErrInvalidMessage
+		}
+		doc = setField(doc, "ack", id())
+		if opts.Channel != "" {
+			doc = setField(doc, "channel", opts.Channel)
+		}
+		if opts.ResetDelay && field(doc, "dead") != true && field(doc, "deleted") == nil {
+			doc = setField(doc, "visible", now)
+		}
+		docs = append(docs, doc)
+		if len(docs) == importBatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, err
+	}
+	return imported, flush()
+}
+
+func field(doc bson.D, key string) any {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+func setField(doc bson.D, key string, value any) bson.D {
+	for i := range doc {
+		if doc[i].Key == key {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, bson.E{Key: key, Value: value})
+}
+
+// insertIgnoreDuplicates 无序写入, 返回成功写入的数量
+func (n *MessageNodeV2) insertIgnoreDuplicates(ctx context.Context, docs []interface{}) (int64, error) {
+	_, err := n.node.coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		n.node.metrics.incAdded(len(docs))
+		return int64(len(docs)), nil
+	}
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return 0, err
+	}
+	for _, we := range bwe.WriteErrors {
+		if !isDuplicateKey(we.Code) {
+			return 0, err
+		}
+	}
+	added := len(docs) - len(bwe.WriteErrors)
+	n.node.metrics.incAdded(added)
+	return int64(added), nil
+}
+
+type ReplayOpts struct {
+	Channel []string // 归档消息原来的 channel, 为空时不限制
+	// 按完成时间过滤, 零值时不限制
+	Since time.Time
+	Until time.Time
+	// 重新投递到的 channel, 为空时投递回原 channel
+	Target string
+	Limit  int64 // 为 0 时不限制
+}
+
+// Replay 将 "<集合名>_history" 中归档的消息作为新消息重新投递, 保留消息内容, 消息头, 优先级和分组,
+// 投递次数清零且不再参与去重. 返回投递的数量
+func (n *MessageNodeV2) Replay(ctx context.Context, opts ReplayOpts) (int64, error) {
+	query := byChannel(bson.M{}, opts.Channel)
+	deleted := bson.M{}
+	if !opts.Since.IsZero() {
+		deleted["$gte"] = opts.Since
+	}
+	if !opts.Until.IsZero() {
+		deleted["$lt"] = opts.Until
+	}
+	if len(deleted) > 0 {
+		query["deleted"] = deleted
+	}
+	cursor, err := n.node.sibling("history").Find(
+		ctx,
+		query,
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(opts.Limit),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var replayed int64
+	docs := make([]interface{}, 0, importBatchSize)
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		if _, err := n.node.coll.InsertMany(ctx, docs); err != nil {
+			return err
+		}
+		n.node.metrics.incAdded(len(docs))
+		replayed += int64(len(docs))
+		docs = docs[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		archived := new(QueueMessage)
+		if err := cursor.Decode(archived); err != nil {
+			return replayed, err
+		}
+		item := Message{
+			Channel:    archived.Channel,
+			MaxTries:   archived.MaxTries,
+			Retry:      archived.Retry,
+			Priority:   archived.Priority,
+			GroupKey:   archived.GroupKey,
+			Headers:    archived.Headers,
+			Visibility: archived.Visibility,
+		}
+		if opts.Target != "" {
+			item.Channel = opts.Target
+		}
+		// 消息内容保持原来的编码, 不需要解密; 游标的缓冲区会被复用, 需要复制
+		payload := cursor.Current.Lookup("message")
+		payload.Value = append([]byte(nil), payload.Value...)
+		docs = append(docs, n.newDoc(ctx, item, payload))
+		if len(docs) == importBatchSize {
+			if err := flush(); err != nil {
+				return replayed, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return replayed, err
+	}
+	return replayed, flush()
+}
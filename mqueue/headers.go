@@ -0,0 +1,58 @@
+package mqueue
+
+import (
+	"context"
+
+	"github.com/yaoshangnetwork/gobase/logger"
+)
+
+// Add 时自动从 ctx 中读取的消息头
+const (
+	HeaderReqId       = "X-Reqid"
+	HeaderTraceparent = "traceparent"
+)
+
+type headersKey struct{}
+
+// mergeHeaders 合并 ctx 中的消息头 (ContextWithHeaders), 请求 ID 和 traceparent 以及 Message.Headers, 后者优先
+func mergeHeaders(ctx context.Context, headers map[string]string) map[string]string {
+	inherited := HeadersFromContext(ctx)
+	result := make(map[string]string, len(inherited)+len(headers)+2)
+	for k, v := range inherited {
+		result[k] = v
+	}
+	if reqId := logger.ReqIdFromContext(ctx); reqId != "" {
+		result[HeaderReqId] = reqId
+	}
+	if traceparent := logger.TraceparentFromContext(ctx); traceparent != "" {
+		result[HeaderTraceparent] = traceparent
+	}
+	for k, v := range headers {
+		result[k] = v
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// ContextWithHeaders 将消息头恢复到 ctx, 请求 ID 和 traceparent 可以通过 logger.FromContext 输出.
+// Worker 调用 handler 前会自动处理, handler 中再 Add 的消息会继承这些消息头
+func ContextWithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	if reqId := headers[HeaderReqId]; reqId != "" {
+		ctx = logger.WithReqId(ctx, reqId)
+	}
+	if traceparent := headers[HeaderTraceparent]; traceparent != "" {
+		ctx = logger.WithTraceparent(ctx, traceparent)
+	}
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// HeadersFromContext 当前处理的消息的消息头
+func HeadersFromContext(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	return headers
+}
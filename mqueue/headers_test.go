@@ -0,0 +1,70 @@
+package mqueue_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/yaoshangnetwork/gobase/logger"
+	"github.com/yaoshangnetwork/gobase/mqueue"
+)
+
+func TestHeadersPropagation(t *testing.T) {
+	node := mqueue.NewMemoryNode(mqueue.MemoryOpts{})
+	ctx := logger.WithTraceparent(logger.WithReqId(context.Background(), "req-1"), "00-trace-span-01")
+	if _, err := node.Add(ctx, mqueue.Message{Channel: "a", Message: "x", MaxTries: 1, Headers: map[string]string{"tenant": "t1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var reqId, traceparent, tenant string
+	w := mqueue.NewWorker(node, mqueue.WorkerOpts{PollInterval: time.Millisecond})
+	w.Handle("a", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		reqId = logger.ReqIdFromContext(ctx)
+		traceparent = logger.TraceparentFromContext(ctx)
+		tenant = mqueue.HeadersFromContext(ctx)["tenant"]
+		// handler 中写入的消息继承全部消息头
+		_, err := node.Add(ctx, mqueue.Message{Channel: "b", Message: "y", MaxTries: 1})
+		return err
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w.Run(ctx)
+
+	if reqId != "req-1" || traceparent != "00-trace-span-01" || tenant != "t1" {
+		t.Error("headers error", reqId, traceparent, tenant)
+	}
+	child, err := node.Get(context.Background(), "b")
+	if err != nil || child.Headers["tenant"] != "t1" || child.Headers[mqueue.HeaderReqId] != "req-1" {
+		t.Error("inherited headers error", child, err)
+	}
+}
+
+// gin 处理函数中传入 c.Request.Context() 时也能读到请求 ID
+func TestHeadersFromGinRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	node := mqueue.NewMemoryNode(mqueue.MemoryOpts{})
+	router := gin.New()
+	router.Use(logger.NewGinMiddleware(log))
+	router.POST("/", func(c *gin.Context) {
+		if _, err := node.Add(c.Request.Context(), mqueue.Message{Channel: "a", Message: "x", MaxTries: 1}); err != nil {
+			c.Status(http.StatusInternalServerError)
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("X-Reqid", "req-2")
+	req.Header.Set("traceparent", "00-trace-span-02")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	message, err := node.Get(context.Background(), "a")
+	if err != nil || message.Headers[mqueue.HeaderReqId] != "req-2" || message.Headers[mqueue.HeaderTraceparent] != "00-trace-span-02" {
+		t.Error("headers error", message, err)
+	}
+}
@@ -0,0 +1,226 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 优先级高的先出, 同优先级按可见时间先后
+var getSort = bson.D{{Key: "priority", Value: -1}, {Key: "visible", Value: 1}}
+
+// 每次从候选游标中读取的数量
+const leaseBatchSize = 16
+
+type candidate struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Channel  string             `bson:"channel"`
+	GroupKey string             `bson:"group_key"`
+}
+
+// lease 对第一条可获取的消息设置租约
+func (n *MessageNodeV2) lease(ctx context.Context, channel []string) (*QueueMessage, error) {
+	var message *QueueMessage
+	err := n.scan(ctx, channel, func(c *candidate, window time.Time) (bool, error) {
+		var err error
+		message, err = n.leaseOne(ctx, c.ID)
+		if err != nil && !window.IsZero() {
+			_ = n.release(ctx, c.Channel, window)
+		}
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// 已被其他消费者获取
+			return false, nil
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if message == nil {
+		return nil, ErrEmpty
+	}
+	return message, nil
+}
+
+// scan 按优先级遍历可见消息, 分组内只取队首的消息, 直到 fn 返回 true.
+// 限流的 channel 在调用 fn 前占用一次投递, window 为所在窗口的开始时间, 消息没有获取成功时需要 release
+func (n *MessageNodeV2) scan(ctx context.Context, channel []string, fn func(c *candidate, window time.Time) (bool, error)) error {
+	controls, exhausted, err := n.channelControls(ctx)
+	if err != nil {
+		return err
+	}
+	query, err := readyQuery(n.node.now(), channel, controls, exhausted)
+	if errors.Is(err, ErrEmpty) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s := &scanState{
+		blocked: make(map[[2]string]bool),
+		limited: make(map[string]bool),
+		seen:    make(map[primitive.ObjectID]bool),
+	}
+	for {
+		q := query
+		if len(s.excluded) > 0 {
+			q = bson.M{"$and": bson.A{query, bson.M{"$nor": s.excluded}}}
+		}
+		more, err := n.scanOnce(ctx, q, controls, s, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// scanState 一次 scan 中已经排除的分组和 channel
+type scanState struct {
+	blocked  map[[2]string]bool
+	limited  map[string]bool // 本次遍历中限流次数已用完的 channel
+	seen     map[primitive.ObjectID]bool
+	excluded bson.A // 重新查询时排除的条件, 与 blocked 和 limited 对应
+	pending  bool   // excluded 在当前查询之后有新增
+}
+
+// scanOnce 遍历一次查询的结果, 当前批次读完且有新排除的分组或 channel 时返回 true, 由 scan 排除后重新查询,
+// 避免队首处理中的分组积压大量消息时逐批读取整个积压
+func (n *MessageNodeV2) scanOnce(ctx context.Context, query bson.M, controls map[string]*ChannelControl, s *scanState, fn func(c *candidate, window time.Time) (bool, error)) (bool, error) {
+	cursor, err := n.node.coll.Find(
+		ctx,
+		query,
+		options.Find().
+			SetSort(getSort).
+			SetProjection(bson.M{"_id": 1, "channel": 1, "group_key": 1}).
+			SetBatchSize(leaseBatchSize),
+	)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close(ctx)
+
+	s.pending = false
+	for {
+		if s.pending && cursor.RemainingBatchLength() == 0 {
+			return true, nil
+		}
+		if !cursor.Next(ctx) {
+			return false, cursor.Err()
+		}
+		c := new(candidate)
+		if err := cursor.Decode(c); err != nil {
+			return false, err
+		}
+		if s.seen[c.ID] || s.limited[c.Channel] {
+			continue
+		}
+		s.seen[c.ID] = true
+		if c.GroupKey != "" {
+			group := [2]string{c.Channel, c.GroupKey}
+			if s.blocked[group] {
+				continue
+			}
+			head, ready, err := n.groupHead(ctx, c)
+			if err != nil {
+				return false, err
+			}
+			if head == nil || head.ID != c.ID {
+				// 队首可能因为重新投递或优先级排在后面, 可见时直接尝试队首, 之后这一分组不再取
+				s.blocked[group] = true
+				s.excluded = append(s.excluded, bson.M{"channel": c.Channel, "group_key": c.GroupKey})
+				s.pending = true
+				if head == nil || !ready || s.seen[head.ID] {
+					continue
+				}
+				s.seen[head.ID] = true
+				c = head
+			}
+		}
+
+		var window time.Time
+		if control := controls[c.Channel]; control != nil && control.limited() {
+			start, ok, err := n.acquire(ctx, control)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				s.limited[c.Channel] = true
+				s.excluded = append(s.excluded, bson.M{"channel": c.Channel})
+				s.pending = true
+				continue
+			}
+			window = start
+		}
+
+		stop, err := fn(c, window)
+		if err != nil || stop {
+			return false, err
+		}
+	}
+}
+
+// leaseUntil 租约到期时间的聚合表达式, 消息设置了 Visibility 时使用它, 否则使用队列的可见时间
+func (n *MessageNodeV2) leaseUntil(now time.Time) bson.M {
+	return bson.M{"$add": bson.A{now, bson.M{"$ifNull": bson.A{
+		bson.M{"$toLong": bson.M{"$divide": bson.A{"$visibility", int64(time.Millisecond)}}},
+		n.node.leaseVisibility().Milliseconds(),
+	}}}}
+}
+
+// leaseOne 消息仍然可见时设置租约
+func (n *MessageNodeV2) leaseOne(ctx context.Context, oid primitive.ObjectID) (*QueueMessage, error) {
+	now := n.node.now()
+	query := bson.M{"_id": oid, "visible": bson.M{"$lte": now}, "dead": false, "deleted": nil}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tries":   bson.M{"$add": bson.A{"$tries", 1}},
+			"ack":     id(),
+			"visible": n.leaseUntil(now),
+		}}},
+	}
+	after := options.After
+	res := n.node.coll.FindOneAndUpdate(ctx, query, update, &options.FindOneAndUpdateOptions{
+		ReturnDocument: &after,
+	})
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	message := new(QueueMessage)
+	if err := res.Decode(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// groupHead 分组内最早 (按 _id) 的未完成消息 (处理中, 等待投递或延迟中) 以及它当前是否可见, 死信不阻塞后续消息.
+// 分组内没有未完成消息时返回 nil
+func (n *MessageNodeV2) groupHead(ctx context.Context, c *candidate) (*candidate, bool, error) {
+	var head struct {
+		candidate `bson:",inline"`
+		Visible   time.Time `bson:"visible"`
+	}
+	err := n.node.coll.FindOne(
+		ctx,
+		bson.M{
+			"channel":   c.Channel,
+			"group_key": c.GroupKey,
+			"dead":      false,
+			"deleted":   nil,
+		},
+		options.FindOne().
+			SetSort(bson.M{"_id": 1}).
+			SetProjection(bson.M{"_id": 1, "channel": 1, "group_key": 1, "visible": 1}),
+	).Decode(&head)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &head.candidate, !head.Visible.After(n.node.now()), nil
+}
@@ -0,0 +1,72 @@
+package mqueue_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行. 队首处理中的分组积压大量消息时, Get 不逐批读取整个积压
+func TestMongoBlockedGroupScan(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	var reads atomic.Int64
+	monitor := &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if e.CommandName == "find" || e.CommandName == "getMore" {
+				reads.Add(1)
+			}
+		},
+	}
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(monitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	clock := mqueue.NewManualClock(time.Now().Truncate(time.Millisecond))
+	mq, err := mqueue.NewMQueueWithDatabaseE(client.Database("mqueue_test"), mqueue.QueueOpts{
+		Mode:  mqueue.DebugMode,
+		DB:    mqueue.DBConfig{Collection: "scan_" + primitive.NewObjectID().Hex()},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.MessageV2.Clear(ctx)
+	node := mq.MessageV2
+
+	backlog := make([]mqueue.Message, 0, 1000)
+	for i := 0; i < cap(backlog); i++ {
+		backlog = append(backlog, mqueue.Message{Channel: "a", Message: fmt.Sprint(i), MaxTries: 1, GroupKey: "g"})
+	}
+	if _, err := node.Add(ctx, backlog...); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	node.Add(ctx, mqueue.Message{Channel: "a", Message: "free", MaxTries: 1})
+	if head, err := node.Get(ctx, "a"); err != nil || head.Message != "0" {
+		t.Fatal("head error", head, err)
+	}
+
+	reads.Store(0)
+	message, err := node.Get(ctx, "a")
+	if err != nil || message.Message != "free" {
+		t.Fatal("expect free message", message, err)
+	}
+	// 不排除分组时需要 1000/16 次以上的 getMore
+	if n := reads.Load(); n > 5 {
+		t.Error("too many reads", n)
+	}
+}
@@ -0,0 +1,427 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/sliceutils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryOpts 与 QueueOpts 中对应字段的含义和默认值一致
+type MemoryOpts struct {
+	Visibility  time.Duration
+	Retry       *RetryPolicy
+	DedupWindow time.Duration
+	Clock       Clock
+	Codec       *CodecOpts
+}
+
+type memoryMessage struct {
+	message  QueueMessage
+	payload  bson.RawValue // 与写入 MongoDB 一样先编码, 取出时解码
+	dedupKey string
+	created  time.Time
+	visible  time.Time
+	dead     bool
+	deleted  *time.Time
+}
+
+func (m *memoryMessage) active() bool {
+	return !m.dead && m.deleted == nil
+}
+
+// MemoryNode 内存中的 IMessageNodeV2 实现, 可见时间, 投递次数, 死信和 ack 的语义与 MongoDB 实现一致,
+// 用于单元测试. 不支持 channel 的暂停和限流, 也不支持 Call 的回复
+type MemoryNode struct {
+	mu          sync.Mutex
+	messages    []*memoryMessage // 按写入顺序, 与 ObjectID 的顺序一致
+	visibility  time.Duration
+	retry       RetryPolicy
+	dedupWindow time.Duration
+	clock       Clock
+	codec       *codec
+	watchers    map[chan struct{}]struct{}
+}
+
+var _ IMessageNodeV2 = (*MemoryNode)(nil)
+
+// NewMemoryNode opts.Codec 配置错误时 panic
+func NewMemoryNode(opts MemoryOpts) *MemoryNode {
+	if opts.Visibility <= 0 {
+		opts.Visibility = DefaultVisibility
+	}
+	if opts.Retry == nil {
+		opts.Retry = &DefaultRetryPolicy
+	}
+	if opts.DedupWindow <= 0 {
+		opts.DedupWindow = DefaultDedupWindow
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	codec, err := newCodec(opts.Codec)
+	if err != nil {
+		panic(err)
+	}
+	return &MemoryNode{
+		visibility:  opts.Visibility,
+		retry:       *opts.Retry,
+		dedupWindow: opts.DedupWindow,
+		clock:       opts.Clock,
+		codec:       codec,
+		watchers:    make(map[chan struct{}]struct{}),
+	}
+}
+
+// Add
+func (m *MemoryNode) Add(ctx context.Context, message ...Message) ([]string, error) {
+	if len(message) == 0 {
+		return nil, ErrInvalidMessage
+	}
+	payloads := make([]bson.RawValue, 0, len(message))
+	for _, item := range message {
+		if item.Channel == "" || item.Message == nil {
+			return nil, ErrInvalidMessage
+		}
+		payload, err := m.codec.encode(item.Message)
+		if err != nil {
+			return nil, err
+		}
+		t, b, err := bson.MarshalValue(payload)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, bson.RawValue{Type: t, Value: b})
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	ids := make([]string, 0, len(message))
+	for i, item := range message {
+		if existing := m.duplicated(item, now); existing != "" {
+			ids = append(ids, existing)
+			continue
+		}
+		msg := &memoryMessage{
+			message: QueueMessage{
+				ID:            primitive.NewObjectID(),
+				Channel:       item.Channel,
+				Ack:           id(),
+				MaxTries:      item.MaxTries,
+				Priority:      item.Priority,
+				GroupKey:      item.GroupKey,
+				CorrelationID: item.CorrelationID,
+				Headers:       mergeHeaders(ctx, item.Headers),
+				Visibility:    item.Visibility,
+			},
+			payload:  payloads[i],
+			dedupKey: item.DedupKey,
+			created:  now,
+			visible:  now.Add(item.Delay),
+		}
+		if item.Retry != nil {
+			retry := *item.Retry
+			msg.message.Retry = &retry
+		}
+		m.messages = append(m.messages, msg)
+		ids = append(ids, msg.message.ID.Hex())
+	}
+	for wake := range m.watchers {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	return ids, nil
+}
+
+// duplicated 窗口期内去重键相同的消息 ID, 已过期的去重键会被释放
+func (m *MemoryNode) duplicated(item Message, now time.Time) string {
+	if item.DedupKey == "" {
+		return ""
+	}
+	for _, msg := range m.messages {
+		if msg.message.Channel != item.Channel || msg.dedupKey != item.DedupKey {
+			continue
+		}
+		if msg.created.Add(m.dedupWindow).After(now) {
+			return msg.message.ID.Hex()
+		}
+		msg.dedupKey = ""
+	}
+	return ""
+}
+
+// Clear 不限制 DebugMode
+func (m *MemoryNode) Clear(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+	return nil
+}
+
+// Get 队列为空时返回 ErrEmpty
+func (m *MemoryNode) Get(ctx context.Context, channel ...string) (*QueueMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+
+	ready := make([]*memoryMessage, 0)
+	for _, msg := range m.messages {
+		if msg.active() && !msg.visible.After(now) && inChannel(msg.message.Channel, channel) {
+			ready = append(ready, msg)
+		}
+	}
+	sort.SliceStable(ready, func(i, j int) bool {
+		if ready[i].message.Priority != ready[j].message.Priority {
+			return ready[i].message.Priority > ready[j].message.Priority
+		}
+		return ready[i].visible.Before(ready[j].visible)
+	})
+	for _, msg := range ready {
+		if msg.message.GroupKey != "" && !m.isGroupHead(msg) {
+			continue
+		}
+		msg.message.Tries++
+		msg.message.Ack = id()
+		msg.visible = now.Add(m.leaseVisibility(msg))
+		if msg.message.Tries > msg.message.MaxTries {
+			// 超过重试次数, 标记为死信后继续取下一条
+			msg.dead = true
+			msg.deleted = &now
+			continue
+		}
+		message, err := msg.copy()
+		if err == nil {
+			message.Message, err = m.codec.decode(message.Message)
+		}
+		if err != nil {
+			// 与 MessageNodeV2.Get 一致, 无法解码的消息进入死信
+			msg.dead = true
+			msg.deleted = &now
+			msg.message.LastError = err.Error()
+			continue
+		}
+		message.Lease = m.leaseVisibility(msg)
+		return message, nil
+	}
+	return nil, ErrEmpty
+}
+
+// GetBatch 逐条获取, 语义与 MessageNodeV2.GetBatch 一致
+func (m *MemoryNode) GetBatch(ctx context.Context, channel string, n int) ([]*QueueMessage, error) {
+	if channel == "" || n <= 0 {
+		return nil, ErrInvalidMessage
+	}
+	result := make([]*QueueMessage, 0, n)
+	for len(result) < n {
+		message, err := m.Get(ctx, channel)
+		if errors.Is(err, ErrEmpty) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	if len(result) == 0 {
+		return nil, ErrEmpty
+	}
+	return result, nil
+}
+
+// AckBatch 返回成功的数量, 不存在或租约已过期的 ack 被忽略
+func (m *MemoryNode) AckBatch(ctx context.Context, acks []string) (int64, error) {
+	var count int64
+	for _, ack := range acks {
+		if err := m.Ack(ctx, ack); err == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// isGroupHead 分组内没有更早的未完成消息
+func (m *MemoryNode) isGroupHead(target *memoryMessage) bool {
+	for _, msg := range m.messages {
+		if msg == target {
+			return true
+		}
+		if msg.active() && msg.message.Channel == target.message.Channel && msg.message.GroupKey == target.message.GroupKey {
+			return false
+		}
+	}
+	return true
+}
+
+func (msg *memoryMessage) copy() (*QueueMessage, error) {
+	message := msg.message
+	if msg.message.Retry != nil {
+		retry := *msg.message.Retry
+		message.Retry = &retry
+	}
+	if msg.message.Headers != nil {
+		message.Headers = make(map[string]string, len(msg.message.Headers))
+		for k, v := range msg.message.Headers {
+			message.Headers[k] = v
+		}
+	}
+	if err := msg.payload.Unmarshal(&message.Message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Watch 新消息写入时立即唤醒, 其他情况按 interval 自适应轮询; ctx 取消后关闭 channel
+func (m *MemoryNode) Watch(ctx context.Context, interval time.Duration, channel ...string) <-chan *QueueMessage {
+	wake := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.watchers[wake] = struct{}{}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.watchers, wake)
+		m.mu.Unlock()
+	}()
+	return poll(ctx, interval, wake, func(ctx context.Context) (*QueueMessage, error) {
+		return m.Get(ctx, channel...)
+	})
+}
+
+// leased 租约未过期的消息
+func (m *MemoryNode) leased(ack string, now time.Time) (*memoryMessage, error) {
+	for _, msg := range m.messages {
+		if msg.message.Ack == ack && msg.active() && msg.visible.After(now) {
+			return msg, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Ack 消息不存在或租约已过期时返回 ErrNotFound
+func (m *MemoryNode) Ack(ctx context.Context, ack string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	msg, err := m.leased(ack, now)
+	if err != nil {
+		return err
+	}
+	msg.deleted = &now
+	return nil
+}
+
+// Nack 处理失败, 按延迟重新投递; 已达到最大投递次数的消息直接标记为死信
+func (m *MemoryNode) Nack(ctx context.Context, ack string, opts NackOpts) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	msg, err := m.leased(ack, now)
+	if err != nil {
+		return err
+	}
+	if opts.Error != "" {
+		msg.message.LastError = opts.Error
+	}
+	if msg.message.Tries >= msg.message.MaxTries {
+		msg.dead = true
+		msg.deleted = &now
+		return nil
+	}
+	delay := opts.Delay
+	if delay <= 0 {
+		retry := m.retry
+		if msg.message.Retry != nil {
+			retry = *msg.message.Retry
+		}
+		delay = retry.Backoff(msg.message.Tries)
+	}
+	msg.message.Ack = id()
+	msg.visible = now.Add(delay)
+	return nil
+}
+
+// Ping 延长租约, 消息不存在或租约已过期时返回 ErrNotFound
+func (m *MemoryNode) Ping(ctx context.Context, ack string, extend ...time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	msg, err := m.leased(ack, now)
+	if err != nil {
+		return err
+	}
+	if len(extend) > 0 && extend[0] > 0 {
+		msg.visible = now.Add(extend[0])
+	} else {
+		msg.visible = now.Add(m.leaseVisibility(msg))
+	}
+	return nil
+}
+
+// leaseVisibility 消息的 Visibility 优先
+func (m *MemoryNode) leaseVisibility(msg *memoryMessage) time.Duration {
+	if msg.message.Visibility > 0 {
+		return msg.message.Visibility
+	}
+	return m.visibility
+}
+
+func (m *MemoryNode) count(channel []string, match func(msg *memoryMessage, now time.Time) bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	var count int64
+	for _, msg := range m.messages {
+		if inChannel(msg.message.Channel, channel) && match(msg, now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Total
+func (m *MemoryNode) Total(ctx context.Context, channel ...string) (int64, error) {
+	return m.count(channel, func(msg *memoryMessage, now time.Time) bool {
+		return true
+	})
+}
+
+// Size
+func (m *MemoryNode) Size(ctx context.Context, channel ...string) (int64, error) {
+	return m.count(channel, func(msg *memoryMessage, now time.Time) bool {
+		return msg.active() && !msg.visible.After(now)
+	})
+}
+
+// InFlight
+func (m *MemoryNode) InFlight(ctx context.Context, channel ...string) (int64, error) {
+	return m.count(channel, func(msg *memoryMessage, now time.Time) bool {
+		return msg.active() && msg.visible.After(now)
+	})
+}
+
+// Done
+func (m *MemoryNode) Done(ctx context.Context, channel ...string) (int64, error) {
+	return m.count(channel, func(msg *memoryMessage, now time.Time) bool {
+		return msg.deleted != nil
+	})
+}
+
+// Dead
+func (m *MemoryNode) Dead(ctx context.Context, channel ...string) (int64, error) {
+	return m.count(channel, func(msg *memoryMessage, now time.Time) bool {
+		return msg.dead
+	})
+}
+
+// inChannel 与 byChannel 一致, 不指定 channel 时不限制
+func inChannel(item string, channel []string) bool {
+	return len(channel) == 0 || sliceutils.Contains(channel, item)
+}
@@ -2,21 +2,28 @@ package mqueue
 
 import (
 	"context"
+	"errors"
 	"log"
-	"reflect"
 	"time"
 
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type MessageNode struct {
-	mode       Mode
-	coll       *mongo.Collection
-	visibility time.Duration
+	mode        Mode
+	coll        *mongo.Collection
+	visibility  time.Duration
+	retry       RetryPolicy
+	dedupWindow time.Duration
+	closed      chan struct{} // MQueue.Close 时关闭
+	metrics     *Metrics
+	controls    *controlCache
+	clock       Clock
+	archive     bool
+	codec       *codec
 }
 
 type IMessageNode interface {
@@ -34,11 +41,25 @@ type IMessageNode interface {
 }
 
 type QueueMessage struct {
-	Channel  string `bson:"channel"`
-	Message  any    `bson:"message"`
-	Ack      string `bson:"ack"`
-	Tries    int    `bson:"tries"`
-	MaxTries int    `bson:"max_tries"`
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Channel   string             `bson:"channel"`
+	Message   any                `bson:"message"`
+	Ack       string             `bson:"ack"`
+	Tries     int                `bson:"tries"`
+	MaxTries  int                `bson:"max_tries"`
+	Retry     *RetryPolicy       `bson:"retry,omitempty"`
+	LastError string             `bson:"last_error,omitempty"` // 最近一次 Nack 的错误信息
+	Priority  int                `bson:"priority"`
+	GroupKey  string             `bson:"group_key,omitempty"`
+	Headers   map[string]string  `bson:"headers,omitempty"`
+	// 取出后的租约时长, 为 0 时使用 QueueOpts.Visibility
+	Visibility time.Duration `bson:"visibility,omitempty"`
+	// 本次取出时实际使用的租约时长, 由 Get/GetBatch 设置, 不保存
+	Lease time.Duration `bson:"-"`
+	// Call 发出的请求, 消费者通过 Reply 回复
+	CorrelationID string `bson:"correlation_id,omitempty"`
+
+	replier func(ctx context.Context, correlationID string, reply *Reply) error
 }
 
 type Message struct {
@@ -46,169 +67,134 @@ type Message struct {
 	Message  any
 	Delay    time.Duration
 	MaxTries int
+	Retry    *RetryPolicy // 覆盖 QueueOpts.Retry
+	DedupKey string       // 同一 channel 内去重, 窗口期内重复 Add 返回已存在的消息 ID
+	Priority int          // 优先级高的可见消息优先被获取, 默认 0
+	GroupKey string       // 同一 channel 内相同 GroupKey 的消息严格按写入顺序逐条处理
+	// 取出后的租约时长, 覆盖 QueueOpts.Visibility, 按处理耗时设置以便失败的消息尽快重新投递
+	Visibility time.Duration
+	// 消息头, Add 时自动加入 ctx 中的请求 ID (X-Reqid) 和 traceparent
+	Headers map[string]string
+	// 请求/回复的关联 ID, 一般由 Call 设置
+	CorrelationID string
+}
+
+// NackOpts Delay 大于 0 时直接使用, 否则按 RetryPolicy 计算
+type NackOpts struct {
+	Delay time.Duration
+	Error string // 失败原因, 记录到 last_error 和 failures
 }
 
 func id() string {
 	return uuid.New().String()
 }
 
+// byChannel 将查询限定在指定的 channel 内, 不传则不限制
+func byChannel(query bson.M, channel []string) bson.M {
+	switch len(channel) {
+	case 0:
+	case 1:
+		query["channel"] = channel[0]
+	default:
+		query["channel"] = bson.M{"$in": channel}
+	}
+	return query
+}
+
 var _ IMessageNode = (*MessageNode)(nil)
 
-// Add
-func (msg *MessageNode) Add(message ...Message) bool {
-	if len(message) == 0 {
-		return false
+func (msg *MessageNode) v2() *MessageNodeV2 {
+	return &MessageNodeV2{node: msg}
+}
+
+// sibling 同一数据库中以队列集合名为前缀的辅助集合
+func (msg *MessageNode) sibling(suffix string) *mongo.Collection {
+	return msg.coll.Database().Collection(msg.coll.Name() + "_" + suffix)
+}
+
+// now 当前时间, 未设置时钟时使用系统时间
+func (msg *MessageNode) now() time.Time {
+	if msg.clock == nil {
+		return time.Now()
 	}
+	return msg.clock.Now()
+}
 
-	for _, m := range message {
-		if m.Channel == "" {
-			return false
-		}
-		if m.Message == nil {
-			return false
-		}
+// leaseVisibility 取出消息后的租约时长
+func (msg *MessageNode) leaseVisibility() time.Duration {
+	if msg.visibility <= 0 {
+		return DefaultVisibility
 	}
+	return msg.visibility
+}
 
-	docs := make([]interface{}, 0)
-	for _, item := range message {
-		doc := map[string]any{
-			"channel":   item.Channel,
-			"ack":       id(),
-			"message":   item.Message,
-			"visible":   time.Now().Add(item.Delay),
-			"tries":     int(0),
-			"max_tries": item.MaxTries,
-			"dead":      false,
-		}
-		docs = append(docs, doc)
+// retryPolicy 消息自带的策略优先
+func (msg *MessageNode) retryPolicy(retry *RetryPolicy) RetryPolicy {
+	if retry != nil {
+		return *retry
 	}
-	_, err := msg.coll.InsertMany(context.Background(), docs)
+	return msg.retry
+}
+
+// Add
+func (msg *MessageNode) Add(message ...Message) bool {
+	_, err := msg.v2().Add(context.Background(), message...)
 	return err == nil
 }
 
 // Clear
 func (msg *MessageNode) Clear() bool {
-	if msg.mode != DebugMode {
+	err := msg.v2().Clear(context.Background())
+	if errors.Is(err, ErrDebugOnly) {
 		log.Print("the \"Clean\" method can only be used in debug mode")
-		return false
 	}
-	err := msg.coll.Drop(context.Background())
 	return err == nil
 }
 
 // Get
 func (msg *MessageNode) Get() (*QueueMessage, bool) {
-	query := bson.M{"visible": bson.M{"$lte": time.Now()}, "dead": false, "deleted": nil}
-	update := bson.M{
-		"$inc": bson.M{"tries": 1},
-		"$set": bson.M{"ack": id(), "visible": time.Now().Add(DefaultVisibility)},
-	}
-	after := options.After
-	res := msg.coll.FindOneAndUpdate(context.Background(), query, update, &options.FindOneAndUpdateOptions{
-		ReturnDocument: &after,
-	})
-	err := res.Err()
-	if err != nil {
-		return nil, false
-	}
-	message := new(QueueMessage)
-	err = res.Decode(message)
-	if err != nil {
-		return nil, false
-	}
-	if message.Tries > message.MaxTries {
-		msg.coll.UpdateOne(
-			context.Background(),
-			bson.M{"ack": message.Ack},
-			bson.M{"$set": bson.M{"dead": true, "deleted": time.Now()}},
-		)
-		return nil, false
-	}
-	return message, true
+	message, err := msg.v2().Get(context.Background())
+	return message, err == nil
 }
 
-// Watch
+// Watch 返回的 channel 不会关闭, 需要停止时使用 MessageNodeV2.Watch
 func (msg *MessageNode) Watch(interval time.Duration) chan *QueueMessage {
-	c := make(chan *QueueMessage)
-	go func() {
-		defer close(c)
-		for {
-			if q, ok := msg.Get(); ok {
-				c <- q
-			}
-			time.Sleep(interval)
-		}
-	}()
-	return c
-}
-
-type ackInfo struct {
-	ID      primitive.ObjectID `bson:"_id,omitempty"`
-	Dead    bool               `bson:"dead"`
-	Visible time.Time          `bson:"visible"`
-	Deleted *time.Time         `bson:"deleted"`
+	return msg.v2().watch(context.Background(), interval, nil)
 }
 
 // Ack
 func (msg *MessageNode) Ack(ack string) bool {
-	item := new(ackInfo)
-	err := msg.coll.FindOne(context.Background(), bson.M{"ack": ack}).Decode(item)
-	if err != nil {
-		return false
-	}
-	if item.Visible.After(time.Now()) && !item.Dead && item.Deleted == nil {
-		res, _ := msg.coll.UpdateByID(context.Background(), item.ID, bson.M{
-			"$set": bson.M{"deleted": time.Now()},
-		})
-		return res.ModifiedCount == 1
-	}
-	return false
+	return msg.v2().Ack(context.Background(), ack) == nil
 }
 
 // Ping
 func (msg *MessageNode) Ping(ack string) bool {
-	query := bson.M{"ack": ack, "visible": bson.M{"$gt": time.Now()}, "dead": false, "deleted": nil}
-	visibility := msg.visibility
-	if visibility <= 0 {
-		visibility = DefaultVisibility
-	}
-	update := bson.M{
-		"$set": bson.M{"visible": time.Now().Add(visibility)},
-	}
-	res, err := msg.coll.UpdateOne(context.Background(), query, update)
-	if err != nil {
-		return false
-	}
-	return res.MatchedCount == 1
+	return msg.v2().Ping(context.Background(), ack) == nil
 }
 
 // Total
 func (msg *MessageNode) Total() (int64, error) {
-	return msg.coll.CountDocuments(context.Background(), bson.M{})
+	return msg.v2().Total(context.Background())
 }
 
 // Size
 func (msg *MessageNode) Size() (int64, error) {
-	query := bson.M{"visible": bson.M{"$lte": time.Now()}, "dead": false, "deleted": nil}
-	return msg.coll.CountDocuments(context.Background(), query)
+	return msg.v2().Size(context.Background())
 }
 
 // InFlight
 func (msg *MessageNode) InFlight() (int64, error) {
-	query := bson.M{"visible": bson.M{"$gt": time.Now()}, "dead": false, "deleted": nil}
-	return msg.coll.CountDocuments(context.Background(), query)
+	return msg.v2().InFlight(context.Background())
 }
 
 // Done
 func (msg *MessageNode) Done() (int64, error) {
-	query := bson.M{"deleted": bson.M{"$exists": true}}
-	return msg.coll.CountDocuments(context.Background(), query)
+	return msg.v2().Done(context.Background())
 }
 
 // Dead
 func (msg *MessageNode) Dead() (int64, error) {
-	query := bson.M{"dead": true}
-	return msg.coll.CountDocuments(context.Background(), query)
+	return msg.v2().Dead(context.Background())
 }
 
 // MessageInt32
@@ -241,44 +227,22 @@ func (item *QueueMessage) MessageBool() (bool, bool) {
 	return v, ok
 }
 
-// MessageDecode
+// MessageDecode 将消息解码到 doc (需为指针), 支持文档, 数组和基础类型
 func (item *QueueMessage) MessageDecode(doc any) bool {
-	switch item.Message.(type) {
-	case primitive.D:
-		return decode(item.Message, doc)
-	case primitive.A:
-		return decodeSlice(item.Message, doc)
-	}
-	return false
+	return decode(item.Message, doc) == nil
 }
 
-func decode(data any, doc any) bool {
-	m, err := bson.Marshal(data)
+// decode 经过 BSON 编码后再解码, 与写入时的序列化方式保持一致.
+// Get 取出的消息已经解密和解压, 这里只处理未经 Get 取出的压缩消息
+func decode(data any, doc any) error {
+	var plain *codec
+	data, err := plain.decode(data)
 	if err != nil {
-		return false
-	}
-	if err = bson.Unmarshal(m, doc); err != nil {
-		return false
+		return err
 	}
-	return true
-}
-
-func decodeSlice(data any, doc any) bool {
-	// 检查 doc 是否是指向切片的指针
-	val := reflect.ValueOf(doc)
-	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Slice {
-		return false
-	}
-	for _, item := range data.(primitive.A) {
-		b, err := bson.Marshal(item)
-		if err != nil {
-			return false
-		}
-		elem := reflect.New(val.Elem().Type().Elem()).Interface()
-		if err := bson.Unmarshal(b, elem); err != nil {
-			return false
-		}
-		val.Elem().Set(reflect.Append(val.Elem(), reflect.ValueOf(elem).Elem()))
+	t, b, err := bson.MarshalValue(data)
+	if err != nil {
+		return err
 	}
-	return true
+	return bson.RawValue{Type: t, Value: b}.Unmarshal(doc)
 }
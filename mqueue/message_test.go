@@ -0,0 +1,40 @@
+package mqueue_test
+
+import (
+	"testing"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type user struct {
+	Name string `bson:"name"`
+	Age  int    `bson:"age"`
+}
+
+func TestMessageDecode(t *testing.T) {
+	item := &mqueue.QueueMessage{Message: primitive.D{{Key: "name", Value: "tom"}, {Key: "age", Value: int32(18)}}}
+	u := new(user)
+	if !item.MessageDecode(u) || u.Name != "tom" || u.Age != 18 {
+		t.Error("decode document error")
+	}
+
+	item = &mqueue.QueueMessage{Message: primitive.A{
+		primitive.D{{Key: "name", Value: "tom"}},
+		primitive.D{{Key: "name", Value: "jerry"}},
+	}}
+	users := make([]user, 0)
+	if !item.MessageDecode(&users) || len(users) != 2 || users[1].Name != "jerry" {
+		t.Error("decode array error")
+	}
+
+	item = &mqueue.QueueMessage{Message: int32(1)}
+	var n int
+	if !item.MessageDecode(&n) || n != 1 {
+		t.Error("decode int error")
+	}
+
+	if item.MessageDecode(&u) {
+		t.Error("expect decode error")
+	}
+}
@@ -0,0 +1,348 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IMessageNodeV2 基于 context 的接口, 通过 error 区分队列为空 (ErrEmpty) 和其他错误.
+// 存储后端有 MongoDB (MessageNodeV2) 和内存 (MemoryNode) 两种实现, 需要 IMessageNode 时使用 NewMessageNodeV1 包装
+type IMessageNodeV2 interface {
+	Add(ctx context.Context, message ...Message) ([]string, error)
+	Clear(ctx context.Context) error // dev mode only
+	Get(ctx context.Context, channel ...string) (*QueueMessage, error)
+	Watch(ctx context.Context, interval time.Duration, channel ...string) <-chan *QueueMessage
+	Ack(ctx context.Context, ack string) error
+	GetBatch(ctx context.Context, channel string, n int) ([]*QueueMessage, error)
+	AckBatch(ctx context.Context, acks []string) (int64, error)
+	Nack(ctx context.Context, ack string, opts NackOpts) error
+	Ping(ctx context.Context, ack string, extend ...time.Duration) error
+	Total(ctx context.Context, channel ...string) (int64, error)
+	Size(ctx context.Context, channel ...string) (int64, error)
+	InFlight(ctx context.Context, channel ...string) (int64, error)
+	Done(ctx context.Context, channel ...string) (int64, error)
+	Dead(ctx context.Context, channel ...string) (int64, error)
+}
+
+type MessageNodeV2 struct {
+	node *MessageNode
+}
+
+var _ IMessageNodeV2 = (*MessageNodeV2)(nil)
+
+// Add 返回新增消息的 ID, ctx 为 mongo.Session 事务的 ctx 时在事务中写入
+func (n *MessageNodeV2) Add(ctx context.Context, message ...Message) ([]string, error) {
+	if len(message) == 0 {
+		return nil, ErrInvalidMessage
+	}
+	for _, m := range message {
+		if m.Channel == "" || m.Message == nil {
+			return nil, ErrInvalidMessage
+		}
+	}
+
+	ids := make([]string, 0, len(message))
+	docs := make([]interface{}, 0, len(message))
+	for _, item := range message {
+		payload, err := n.node.codec.encode(item.Message)
+		if err != nil {
+			return nil, err
+		}
+		doc := n.newDoc(ctx, item, payload)
+		ids = append(ids, doc["_id"].(primitive.ObjectID).Hex())
+		docs = append(docs, doc)
+	}
+	if mongo.SessionFromContext(ctx) != nil {
+		return n.addInTransaction(ctx, ids, docs)
+	}
+
+	added := len(docs)
+	_, err := n.node.coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		// 去重键冲突的消息返回已存在的消息 ID
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+			return nil, err
+		}
+		for _, we := range bwe.WriteErrors {
+			doc := docs[we.Index].(bson.M)
+			if !isDuplicateKey(we.Code) || doc["dedup_key"] == nil {
+				return nil, err
+			}
+			existing, derr := n.dedup(ctx, doc)
+			if derr != nil {
+				return nil, derr
+			}
+			ids[we.Index] = existing
+			if existing != doc["_id"].(primitive.ObjectID).Hex() {
+				added--
+			}
+		}
+	}
+	n.node.metrics.incAdded(added)
+	return ids, nil
+}
+
+// addInTransaction 事务中写入失败会导致整个事务中止, 带去重键的消息通过 upsert 写入, 不会产生去重键冲突.
+// 并发事务写入相同去重键时返回 WriteConflict, 由 mongo.Session.WithTransaction 重试后返回已存在的消息 ID.
+// 无法确定事务是否提交, 事务中写入的消息不计入 Metrics
+func (n *MessageNodeV2) addInTransaction(ctx context.Context, ids []string, docs []interface{}) ([]string, error) {
+	pending := make([]interface{}, 0, len(docs))
+	first := make(map[[2]any]int) // 同一次调用中相同的去重键只写入第一条
+	for i, item := range docs {
+		doc := item.(bson.M)
+		if doc["dedup_key"] == nil {
+			pending = append(pending, doc)
+			continue
+		}
+		key := [2]any{doc["channel"], doc["dedup_key"]}
+		if j, ok := first[key]; ok {
+			ids[i] = ids[j]
+			continue
+		}
+		first[key] = i
+		id, err := n.upsertDedup(ctx, doc)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	if len(pending) > 0 {
+		if _, err := n.node.coll.InsertMany(ctx, pending); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// upsertDedup 去重键不存在时写入 doc, 返回写入或已存在的消息 ID; 已过期的去重键先被释放
+func (n *MessageNodeV2) upsertDedup(ctx context.Context, doc bson.M) (string, error) {
+	existing, err := n.duplicated(ctx, doc)
+	if err != nil || existing != "" {
+		return existing, err
+	}
+	filter := bson.M{"channel": doc["channel"], "dedup_key": doc["dedup_key"]}
+	insert := bson.M{}
+	for k, v := range doc {
+		// 查询条件中的字段在 upsert 时自动写入
+		if _, ok := filter[k]; !ok {
+			insert[k] = v
+		}
+	}
+	var result struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = n.node.coll.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$setOnInsert": insert},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After).SetProjection(bson.M{"_id": 1}),
+	).Decode(&result)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", fmt.Errorf("%w: %v", ErrDuplicate, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return result.ID.Hex(), nil
+}
+
+// newDoc 新消息的文档, payload 为编码后的消息内容
+func (n *MessageNodeV2) newDoc(ctx context.Context, item Message, payload any) bson.M {
+	oid := primitive.NewObjectID()
+	doc := bson.M{
+		"_id":       oid,
+		"channel":   item.Channel,
+		"ack":       id(),
+		"message":   payload,
+		"created":   n.node.now(),
+		"visible":   n.node.now().Add(item.Delay),
+		"tries":     int(0),
+		"max_tries": item.MaxTries,
+		"priority":  item.Priority,
+		"dead":      false,
+	}
+	if item.Visibility > 0 {
+		doc["visibility"] = item.Visibility
+	}
+	if item.GroupKey != "" {
+		doc["group_key"] = item.GroupKey
+	}
+	if headers := mergeHeaders(ctx, item.Headers); headers != nil {
+		doc["headers"] = headers
+	}
+	if item.CorrelationID != "" {
+		doc["correlation_id"] = item.CorrelationID
+	}
+	if item.Retry != nil {
+		doc["retry"] = item.Retry
+	}
+	if item.DedupKey != "" {
+		doc["dedup_key"] = item.DedupKey
+	}
+	return doc
+}
+
+// Clear
+func (n *MessageNodeV2) Clear(ctx context.Context) error {
+	if n.node.mode != DebugMode {
+		return ErrDebugOnly
+	}
+	return n.node.coll.Drop(ctx)
+}
+
+// Get 队列为空时返回 ErrEmpty, 无法解码的消息进入死信, last_error 为解码的错误
+func (n *MessageNodeV2) Get(ctx context.Context, channel ...string) (*QueueMessage, error) {
+	for {
+		message, err := n.lease(ctx, channel)
+		if err != nil {
+			return nil, err
+		}
+		if message.Tries > message.MaxTries {
+			// 超过重试次数, 标记为死信后继续取下一条
+			if err := n.markDead(ctx, []string{message.Ack}, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := n.prepare(message); err != nil {
+			// 无法解码 (如缺少密钥) 时重试也不会成功, 直接进入死信并记录原因, 补充密钥后可以 Requeue
+			if err := n.markDead(ctx, []string{message.Ack}, err.Error()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return message, nil
+	}
+}
+
+// Ack 消息不存在或租约已过期时返回 ErrNotFound, 开启 QueueOpts.Archive 时同时写入历史集合, 写入失败不影响 Ack 的结果
+func (n *MessageNodeV2) Ack(ctx context.Context, ack string) error {
+	query := bson.M{"ack": ack, "visible": bson.M{"$gt": n.node.now()}, "dead": false, "deleted": nil}
+	update := bson.M{"$set": bson.M{"deleted": n.node.now()}}
+	if n.node.archive {
+		after := options.After
+		doc, err := n.node.coll.FindOneAndUpdate(ctx, query, update, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &after,
+		}).Raw()
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return ErrNotFound
+			}
+			return err
+		}
+		n.node.metrics.incAcked(1)
+		n.archiveAcked(ctx, doc)
+		return nil
+	}
+
+	res, err := n.node.coll.UpdateOne(ctx, query, update)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount != 1 {
+		return ErrNotFound
+	}
+	n.node.metrics.incAcked(1)
+	return nil
+}
+
+// Nack 处理失败, 按延迟重新投递; 已达到最大投递次数的消息直接标记为死信
+func (n *MessageNodeV2) Nack(ctx context.Context, ack string, opts NackOpts) error {
+	query := bson.M{"ack": ack, "visible": bson.M{"$gt": n.node.now()}, "dead": false, "deleted": nil}
+	message := new(QueueMessage)
+	if err := n.node.coll.FindOne(ctx, query).Decode(message); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	var set bson.M
+	if message.Tries >= message.MaxTries {
+		now := n.node.now()
+		set = bson.M{"dead": true, "deleted": now, "dead_at": now}
+	} else {
+		delay := opts.Delay
+		if delay <= 0 {
+			delay = n.node.retryPolicy(message.Retry).Backoff(message.Tries)
+		}
+		// 更换 ack, 旧的 ack 不能再 Ack/Ping
+		set = bson.M{"ack": id(), "visible": n.node.now().Add(delay)}
+	}
+	update := bson.M{"$set": set}
+	if opts.Error != "" {
+		set["last_error"] = opts.Error
+		update["$push"] = bson.M{"failures": bson.M{
+			"$each":  bson.A{Failure{Tries: message.Tries, Error: opts.Error, At: n.node.now()}},
+			"$slice": -maxFailures,
+		}}
+	}
+	res, err := n.node.coll.UpdateOne(ctx, query, update)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount != 1 {
+		return ErrNotFound
+	}
+	n.node.metrics.incNacked()
+	if set["dead"] == true {
+		n.node.metrics.incDead(1)
+	}
+	return nil
+}
+
+// Ping 延长租约, 消息不存在或租约已过期时返回 ErrNotFound.
+// 租约从现在起延长 extend, 不传时与 Get 相同 (消息的 Visibility 或队列的可见时间)
+func (n *MessageNodeV2) Ping(ctx context.Context, ack string, extend ...time.Duration) error {
+	now := n.node.now()
+	query := bson.M{"ack": ack, "visible": bson.M{"$gt": now}, "dead": false, "deleted": nil}
+	var update any = mongo.Pipeline{{{Key: "$set", Value: bson.M{"visible": n.leaseUntil(now)}}}}
+	if len(extend) > 0 && extend[0] > 0 {
+		update = bson.M{"$set": bson.M{"visible": now.Add(extend[0])}}
+	}
+	res, err := n.node.coll.UpdateOne(ctx, query, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount != 1 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Total
+func (n *MessageNodeV2) Total(ctx context.Context, channel ...string) (int64, error) {
+	return n.node.coll.CountDocuments(ctx, byChannel(bson.M{}, channel))
+}
+
+// Size
+func (n *MessageNodeV2) Size(ctx context.Context, channel ...string) (int64, error) {
+	query := bson.M{"visible": bson.M{"$lte": n.node.now()}, "dead": false, "deleted": nil}
+	return n.node.coll.CountDocuments(ctx, byChannel(query, channel))
+}
+
+// InFlight
+func (n *MessageNodeV2) InFlight(ctx context.Context, channel ...string) (int64, error) {
+	query := bson.M{"visible": bson.M{"$gt": n.node.now()}, "dead": false, "deleted": nil}
+	return n.node.coll.CountDocuments(ctx, byChannel(query, channel))
+}
+
+// Done
+func (n *MessageNodeV2) Done(ctx context.Context, channel ...string) (int64, error) {
+	query := bson.M{"deleted": bson.M{"$exists": true}}
+	return n.node.coll.CountDocuments(ctx, byChannel(query, channel))
+}
+
+// Dead
+func (n *MessageNodeV2) Dead(ctx context.Context, channel ...string) (int64, error) {
+	query := bson.M{"dead": true}
+	return n.node.coll.CountDocuments(ctx, byChannel(query, channel))
+}
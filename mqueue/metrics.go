@@ -0,0 +1,192 @@
+package mqueue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 与 Prometheus 客户端默认的 bucket 一致 (秒)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics 进程内的计数器, 重启后清零
+type Metrics struct {
+	added  atomic.Int64
+	acked  atomic.Int64
+	nacked atomic.Int64
+	dead   atomic.Int64
+	// Ack 成功但写入历史集合失败的消息数
+	archiveFailed atomic.Int64
+
+	mu      sync.Mutex
+	latency map[string]*histogram // 按 channel
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{latency: make(map[string]*histogram)}
+}
+
+func (m *Metrics) incAdded(n int) {
+	if m != nil {
+		m.added.Add(int64(n))
+	}
+}
+
+func (m *Metrics) incAcked(n int) {
+	if m != nil {
+		m.acked.Add(int64(n))
+	}
+}
+
+func (m *Metrics) incNacked() {
+	if m != nil {
+		m.nacked.Add(1)
+	}
+}
+
+func (m *Metrics) incDead(n int) {
+	if m != nil {
+		m.dead.Add(int64(n))
+	}
+}
+
+func (m *Metrics) incArchiveFailed(n int) {
+	if m != nil {
+		m.archiveFailed.Add(int64(n))
+	}
+}
+
+// ObserveHandler 记录 handler 的处理耗时, Worker 会自动调用
+func (m *Metrics) ObserveHandler(channel string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.latency[channel]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[channel] = h
+	}
+	v := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics 当前队列的计数器
+func (n *MessageNodeV2) Metrics() *Metrics {
+	return n.node.metrics
+}
+
+// WriteMetrics 以 Prometheus 文本格式输出各 channel 的统计和计数器
+func (mq *MQueue) WriteMetrics(ctx context.Context, w io.Writer) error {
+	stats, err := mq.MessageV2.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	coll := escapeLabel(mq.Message.coll.Name())
+	b := new(strings.Builder)
+	writeStats(b, coll, stats)
+	mq.Message.metrics.write(b, coll)
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// writeStats 各 channel 的统计, coll 为已经转义的集合名
+func writeStats(b *strings.Builder, coll string, stats []*ChannelStats) {
+	b.WriteString("# HELP mqueue_messages Number of messages by channel and state.\n")
+	b.WriteString("# TYPE mqueue_messages gauge\n")
+	for _, s := range stats {
+		channel := escapeLabel(s.Channel)
+		for _, item := range []struct {
+			state string
+			value int64
+		}{{"ready", s.Ready}, {"in_flight", s.InFlight}, {"done", s.Done}, {"dead", s.Dead}} {
+			fmt.Fprintf(b, "mqueue_messages{collection=\"%s\",channel=\"%s\",state=\"%s\"} %d\n", coll, channel, item.state, item.value)
+		}
+	}
+	b.WriteString("# HELP mqueue_oldest_ready_age_seconds Age of the oldest visible message.\n")
+	b.WriteString("# TYPE mqueue_oldest_ready_age_seconds gauge\n")
+	for _, s := range stats {
+		fmt.Fprintf(b, "mqueue_oldest_ready_age_seconds{collection=\"%s\",channel=\"%s\"} %s\n", coll, escapeLabel(s.Channel), formatFloat(s.OldestAge))
+	}
+	b.WriteString("# HELP mqueue_avg_tries Average delivery attempts per message.\n")
+	b.WriteString("# TYPE mqueue_avg_tries gauge\n")
+	for _, s := range stats {
+		fmt.Fprintf(b, "mqueue_avg_tries{collection=\"%s\",channel=\"%s\"} %s\n", coll, escapeLabel(s.Channel), formatFloat(s.AvgTries))
+	}
+}
+
+// write 计数器和 handler 耗时, coll 为已经转义的集合名
+func (m *Metrics) write(b *strings.Builder, coll string) {
+	for _, item := range []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"mqueue_added_total", "Messages added by this process.", m.added.Load()},
+		{"mqueue_acked_total", "Messages acked by this process.", m.acked.Load()},
+		{"mqueue_nacked_total", "Messages nacked by this process.", m.nacked.Load()},
+		{"mqueue_dead_total", "Messages dead-lettered by this process.", m.dead.Load()},
+		{"mqueue_archive_failed_total", "Acked messages that could not be archived.", m.archiveFailed.Load()},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", item.name, item.help, item.name)
+		fmt.Fprintf(b, "%s{collection=\"%s\"} %d\n", item.name, coll, item.value)
+	}
+
+	b.WriteString("# HELP mqueue_handler_duration_seconds Handler latency by channel.\n")
+	b.WriteString("# TYPE mqueue_handler_duration_seconds histogram\n")
+	m.mu.Lock()
+	channels := make([]string, 0, len(m.latency))
+	for channel := range m.latency {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		h := m.latency[channel]
+		labels := fmt.Sprintf("collection=\"%s\",channel=\"%s\"", coll, escapeLabel(channel))
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(b, "mqueue_handler_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(b, "mqueue_handler_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(b, "mqueue_handler_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(b, "mqueue_handler_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	m.mu.Unlock()
+}
+
+// MetricsHandler 供 Prometheus 抓取的 http.Handler
+func (mq *MQueue) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := mq.WriteMetrics(r.Context(), w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
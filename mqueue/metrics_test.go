@@ -0,0 +1,75 @@
+package mqueue
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveHandler(t *testing.T) {
+	m := newMetrics()
+	m.ObserveHandler("a", 3*time.Millisecond)
+	m.ObserveHandler("a", 200*time.Millisecond)
+	m.ObserveHandler("a", time.Minute)
+
+	h := m.latency["a"]
+	if h.count != 3 {
+		t.Fatal("count error", h.count)
+	}
+	// bucket 是累计值, 超过最大 bound 的只计入 +Inf
+	for i, want := range []uint64{1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2} {
+		if h.counts[i] != want {
+			t.Error("bucket error", latencyBuckets[i], h.counts[i])
+		}
+	}
+	if h.sum < 60.2 || h.sum > 60.21 {
+		t.Error("sum error", h.sum)
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.ObserveHandler("a", time.Second)
+}
+
+func TestWriteMetrics(t *testing.T) {
+	m := newMetrics()
+	m.incAdded(3)
+	m.incArchiveFailed(1)
+	m.ObserveHandler("b", 2*time.Second)
+	m.ObserveHandler(`a"\`+"\n", 20*time.Second)
+
+	b := new(strings.Builder)
+	coll := escapeLabel(`q"1`)
+	writeStats(b, coll, []*ChannelStats{{Channel: "a\nb", Ready: 2, Dead: 1, AvgTries: 1.5, OldestAge: 0.25}})
+	m.write(b, coll)
+	out := b.String()
+
+	for _, want := range []string{
+		`mqueue_messages{collection="q\"1",channel="a\nb",state="ready"} 2`,
+		`mqueue_messages{collection="q\"1",channel="a\nb",state="dead"} 1`,
+		`mqueue_oldest_ready_age_seconds{collection="q\"1",channel="a\nb"} 0.25`,
+		`mqueue_avg_tries{collection="q\"1",channel="a\nb"} 1.5`,
+		`mqueue_added_total{collection="q\"1"} 3`,
+		`mqueue_archive_failed_total{collection="q\"1"} 1`,
+		"# TYPE mqueue_handler_duration_seconds histogram",
+		`mqueue_handler_duration_seconds_bucket{collection="q\"1",channel="b",le="2.5"} 1`,
+		`mqueue_handler_duration_seconds_bucket{collection="q\"1",channel="b",le="+Inf"} 1`,
+		`mqueue_handler_duration_seconds_sum{collection="q\"1",channel="b"} 2`,
+		`mqueue_handler_duration_seconds_count{collection="q\"1",channel="b"} 1`,
+		`mqueue_handler_duration_seconds_bucket{collection="q\"1",channel="a\"\\\n",le="10"} 0`,
+		`mqueue_handler_duration_seconds_bucket{collection="q\"1",channel="a\"\\\n",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Error("missing line", want)
+		}
+	}
+	// 每个样本占一行, label 中的换行已转义
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "mqueue_") {
+			t.Error("invalid line", line)
+		}
+	}
+	// channel 按名称排序输出
+	if strings.Index(out, `channel="a\"`) > strings.Index(out, `channel="b"`) {
+		t.Error("channel order error")
+	}
+}
@@ -2,24 +2,37 @@ package mqueue
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type MQueue struct {
-	opts    *QueueOpts
-	Message MessageNode
+	opts      *QueueOpts
+	Message   MessageNode
+	MessageV2 *MessageNodeV2
+	client    *mongo.Client
+	closeOnce sync.Once
 }
 
 type Mode string
 
 const (
-	DebugMode         Mode = "debug"
-	ReleaseMode       Mode = "release"
-	DefaultVisibility      = time.Minute * 5
+	DebugMode             Mode = "debug"
+	ReleaseMode           Mode = "release"
+	DefaultVisibility          = time.Minute * 5
+	DefaultDedupWindow         = time.Hour * 24
+	DefaultCallTimeout         = time.Second * 30
+	DefaultReplyRetention      = time.Hour
+	DefaultDoneRetention       = time.Hour * 24 * 7
+	DefaultDeadRetention       = time.Hour * 24 * 7
+	DefaultMaxTries            = 1
 )
 
 type Channel struct {
@@ -28,60 +41,294 @@ type Channel struct {
 }
 
 type QueueOpts struct {
-	Mode       Mode
-	DB         DBConfig
-	Visibility time.Duration
+	Mode        Mode
+	DB          DBConfig
+	Visibility  time.Duration
+	Retry       *RetryPolicy  // 默认 DefaultRetryPolicy
+	DedupWindow time.Duration // Message.DedupKey 的去重窗口, 默认 DefaultDedupWindow
+	Clock       Clock         // 默认系统时间
+	// 已完成和死信消息的保留时间, 默认 DefaultDoneRetention/DefaultDeadRetention.
+	// 显式设置时启动会修改已有 TTL 索引的保留时间, 未设置时沿用已有索引; 保留时间是集合级别的, 只应由一个服务设置
+	DoneRetention time.Duration
+	DeadRetention time.Duration
+	// Ack 时将消息复制到 "<集合名>_history" 用于审计, 历史记录不会自动删除
+	Archive bool
+	// 消息内容的压缩和加密, 默认不处理
+	Codec *CodecOpts
+	// 不创建索引也不修改已有索引, 用于 mqueuectl 等操作线上集合的工具, 索引由服务自己维护
+	SkipIndexes bool
 }
 
 func NewMQueue(opts QueueOpts) *MQueue {
+	mq, err := NewMQueueE(opts)
+	if err != nil {
+		panic(err)
+	}
+	return mq
+}
+
+// NewMQueueE 连接或创建索引失败时返回错误, 不会 panic
+func NewMQueueE(opts QueueOpts) (*MQueue, error) {
+	database, err := connect(opts.DB)
+	if err != nil {
+		return nil, err
+	}
+	mq, err := NewMQueueWithDatabaseE(database, opts)
+	if err != nil {
+		database.Client().Disconnect(context.Background())
+		return nil, err
+	}
+	// 自己创建的连接在 Close 时断开
+	mq.client = database.Client()
+	return mq, nil
+}
+
+// NewMQueueWithDatabase 使用已有的数据库连接, 集合名取 opts.DB.Collection, opts.DB 的其他字段被忽略.
+// 与业务共用连接时, MessageNodeV2.Add 传入 mongo.Session 事务的 ctx 即可与业务写入一起提交或回滚
+func NewMQueueWithDatabase(database *mongo.Database, opts QueueOpts) *MQueue {
+	mq, err := NewMQueueWithDatabaseE(database, opts)
+	if err != nil {
+		panic(err)
+	}
+	return mq
+}
+
+// NewMQueueWithDatabaseE 创建索引失败或 CodecOpts 配置错误时返回错误, 设置 SkipIndexes 时不访问数据库
+func NewMQueueWithDatabaseE(database *mongo.Database, opts QueueOpts) (*MQueue, error) {
 	if opts.Mode == "" {
 		opts.Mode = ReleaseMode
 	}
-	database := connect(opts.DB)
+	if opts.Retry == nil {
+		opts.Retry = &DefaultRetryPolicy
+	}
+	if opts.DedupWindow <= 0 {
+		opts.DedupWindow = DefaultDedupWindow
+	}
+
+	codec, err := newCodec(opts.Codec)
+	if err != nil {
+		return nil, err
+	}
 
 	mq := &MQueue{
 		opts: &opts,
 		Message: MessageNode{
-			mode:       opts.Mode,
-			coll:       database.Collection(opts.DB.Collection),
-			visibility: opts.Visibility,
+			mode:        opts.Mode,
+			coll:        database.Collection(opts.DB.Collection),
+			visibility:  opts.Visibility,
+			retry:       *opts.Retry,
+			dedupWindow: opts.DedupWindow,
+			closed:      make(chan struct{}),
+			metrics:     newMetrics(),
+			controls:    newControlCache(),
+			clock:       opts.Clock,
+			archive:     opts.Archive,
+			codec:       codec,
 		},
 	}
+	mq.MessageV2 = mq.Message.v2()
+	if opts.SkipIndexes {
+		return mq, nil
+	}
 
-	mq.createIndexes()
-	return mq
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := mq.createIndexes(ctx); err != nil {
+		return nil, err
+	}
+	return mq, nil
 }
 
-// createIndexes
-func (mq *MQueue) createIndexes() {
-	// mq.Message.coll.Indexes().DropAll(context.Background())
-
-	_, err := mq.Message.coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
-		Keys: bson.D{
-			{Key: "visible", Value: 1},
-			{Key: "dead", Value: 1},
-			{Key: "deleted", Value: 1},
-		},
+// Close 停止所有 Watch, 由 NewMQueue/NewMQueueE 创建的连接会被断开, 使用已有连接时不会断开
+func (mq *MQueue) Close(ctx context.Context) error {
+	mq.closeOnce.Do(func() {
+		close(mq.Message.closed)
 	})
-	if err != nil {
-		panic(err)
+	if mq.client != nil {
+		return mq.client.Disconnect(ctx)
 	}
+	return nil
+}
 
-	// ack 唯一索引
-	_, err = mq.Message.coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
-		Keys:    bson.D{{Key: "ack", Value: 1}},
-		Options: options.Index().SetUnique(true),
-	})
-	if err != nil {
-		panic(err)
+type HealthStatus struct {
+	Connected bool     `json:"connected"`
+	Indexes   bool     `json:"indexes"`           // 索引是否全部存在
+	Missing   []string `json:"missing,omitempty"` // 缺少的索引, 格式为 "集合名.索引名"
+	Error     string   `json:"error,omitempty"`
+}
+
+// Health 检查连接和索引, 不健康时同时返回 error, 可以直接用于 readiness 探针
+func (mq *MQueue) Health(ctx context.Context) (*HealthStatus, error) {
+	status := &HealthStatus{Missing: []string{}}
+	if err := mq.Message.coll.Database().Client().Ping(ctx, readpref.Primary()); err != nil {
+		status.Error = err.Error()
+		return status, err
 	}
+	status.Connected = true
 
-	// 已完成的 queue message 保留 7 天数据
-	_, err = mq.Message.coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
-		Keys:    bson.D{bson.E{Key: "deleted", Value: 1}},
-		Options: options.Index().SetExpireAfterSeconds(3600 * 24 * 7),
-	})
-	if err != nil {
-		panic(err)
+	existing := make(map[string]map[string]bool)
+	for _, index := range mq.indexes() {
+		name := index.coll.Name()
+		if existing[name] == nil {
+			names, err := index.coll.Indexes().ListSpecifications(ctx)
+			if err != nil {
+				status.Error = err.Error()
+				return status, err
+			}
+			existing[name] = make(map[string]bool)
+			for _, spec := range names {
+				existing[name][spec.Name] = true
+			}
+		}
+		if key := indexName(index.model.Keys.(bson.D)); !existing[name][key] {
+			status.Missing = append(status.Missing, name+"."+key)
+		}
+	}
+	status.Indexes = len(status.Missing) == 0
+	if !status.Indexes {
+		err := fmt.Errorf("%w: %s", ErrMissingIndex, strings.Join(status.Missing, ", "))
+		status.Error = err.Error()
+		return status, err
+	}
+	return status, nil
+}
+
+type queueIndex struct {
+	coll  *mongo.Collection
+	model mongo.IndexModel
+}
+
+// indexes 队列使用的全部索引
+func (mq *MQueue) indexes() []queueIndex {
+	coll := mq.Message.coll
+	done, dead := mq.opts.DoneRetention, mq.opts.DeadRetention
+	if done <= 0 {
+		done = DefaultDoneRetention
+	}
+	if dead <= 0 {
+		dead = DefaultDeadRetention
+	}
+	return []queueIndex{
+		{coll, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "visible", Value: 1},
+				{Key: "dead", Value: 1},
+				{Key: "deleted", Value: 1},
+			},
+		}},
+		// 按优先级获取消息
+		{coll, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "dead", Value: 1},
+				{Key: "deleted", Value: 1},
+				{Key: "priority", Value: -1},
+				{Key: "visible", Value: 1},
+			},
+		}},
+		// 按 channel 和优先级获取消息
+		{coll, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "channel", Value: 1},
+				{Key: "dead", Value: 1},
+				{Key: "deleted", Value: 1},
+				{Key: "priority", Value: -1},
+				{Key: "visible", Value: 1},
+			},
+		}},
+		// 查找分组内最早的未完成消息
+		{coll, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "channel", Value: 1},
+				{Key: "group_key", Value: 1},
+				{Key: "_id", Value: 1},
+			},
+			Options: options.Index().SetPartialFilterExpression(bson.M{"group_key": bson.M{"$exists": true}}),
+		}},
+		// ack 唯一索引
+		{coll, mongo.IndexModel{
+			Keys:    bson.D{{Key: "ack", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		}},
+		// 去重键唯一索引, 只对设置了 dedup_key 的消息生效
+		{coll, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "channel", Value: 1},
+				{Key: "dedup_key", Value: 1},
+			},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"dedup_key": bson.M{"$exists": true}}),
+		}},
+		// 查询到期的定时任务
+		{mq.Message.sibling("schedules"), mongo.IndexModel{
+			Keys: bson.D{{Key: "next", Value: 1}},
+		}},
+		// 按 topic 查询订阅
+		{mq.Message.sibling("subscriptions"), mongo.IndexModel{
+			Keys: bson.D{{Key: "topic", Value: 1}},
+		}},
+		// Call 的回复只保留一段时间
+		{mq.Message.sibling("replies"), mongo.IndexModel{
+			Keys:    bson.D{{Key: "created", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(DefaultReplyRetention.Seconds())),
+		}},
+		// 已完成的消息保留 DoneRetention
+		{coll, mongo.IndexModel{
+			Keys: bson.D{bson.E{Key: "deleted", Value: 1}},
+			Options: options.Index().
+				SetExpireAfterSeconds(int32(done.Seconds())).
+				SetPartialFilterExpression(bson.M{"dead": false}),
+		}},
+		// 死信保留 DeadRetention
+		{coll, mongo.IndexModel{
+			Keys:    bson.D{bson.E{Key: "dead_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(dead.Seconds())),
+		}},
+	}
+}
+
+// createIndexes
+func (mq *MQueue) createIndexes(ctx context.Context) error {
+	// 只有显式设置的保留时间会修改已有的 TTL 索引
+	explicit := map[string]bool{
+		"deleted_1": mq.opts.DoneRetention > 0,
+		"dead_at_1": mq.opts.DeadRetention > 0,
+	}
+	for _, index := range mq.indexes() {
+		if index.model.Options != nil && index.model.Options.ExpireAfterSeconds != nil {
+			create, err := migrateTTL(ctx, index, explicit[indexName(index.model.Keys.(bson.D))])
+			if err != nil {
+				return err
+			}
+			if !create {
+				continue
+			}
+		}
+		if _, err := index.coll.Indexes().CreateOne(ctx, index.model); err != nil {
+			return err
+		}
+	}
+	if err := mq.backfillPriority(ctx); err != nil {
+		return err
+	}
+	return mq.backfillDeadAt(ctx)
+}
+
+// backfillPriority 旧版本的消息没有 priority, 不补齐时按 priority 降序排在所有消息之后
+func (mq *MQueue) backfillPriority(ctx context.Context) error {
+	_, err := mq.Message.coll.UpdateMany(
+		ctx,
+		bson.M{"priority": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"priority": 0}},
+	)
+	return err
+}
+
+// indexName 与驱动生成的默认索引名一致
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
 	}
+	return strings.Join(parts, "_")
 }
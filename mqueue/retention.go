@@ -0,0 +1,108 @@
+package mqueue
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/yaoshangnetwork/gobase/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type indexInfo struct {
+	Name               string   `bson:"name"`
+	ExpireAfterSeconds *int32   `bson:"expireAfterSeconds"`
+	PartialFilter      bson.Raw `bson:"partialFilterExpression"`
+}
+
+// migrateTTL 检查已有的 TTL 索引, 返回 false 时保留已有索引, 不再调用 CreateOne.
+// migrate 为 true (显式设置了保留时间) 时按配置修改: 过滤条件变化 (如旧版本没有过滤条件的 deleted 索引) 时删除后由 createIndexes 重建,
+// 只有保留时间不同时通过 collMod 修改. 否则沿用已有的保留时间, 过滤条件变化时以已有的保留时间重建,
+// 避免使用默认配置的进程改掉其他服务设置的保留时间
+func migrateTTL(ctx context.Context, index queueIndex, migrate bool) (bool, error) {
+	name := indexName(index.model.Keys.(bson.D))
+	cursor, err := index.coll.Indexes().List(ctx)
+	if err != nil {
+		return false, err
+	}
+	existing := make([]*indexInfo, 0)
+	if err := cursor.All(ctx, &existing); err != nil {
+		return false, err
+	}
+
+	var partial bson.Raw
+	if filter := index.model.Options.PartialFilterExpression; filter != nil {
+		if partial, err = bson.Marshal(filter); err != nil {
+			return false, err
+		}
+	}
+	expire := *index.model.Options.ExpireAfterSeconds
+	for _, info := range existing {
+		if info.Name != name {
+			continue
+		}
+		if !bytes.Equal(info.PartialFilter, partial) {
+			if !migrate && info.ExpireAfterSeconds != nil {
+				index.model.Options.SetExpireAfterSeconds(*info.ExpireAfterSeconds)
+			}
+			_, err := index.coll.Indexes().DropOne(ctx, name)
+			return true, err
+		}
+		if info.ExpireAfterSeconds != nil && *info.ExpireAfterSeconds == expire {
+			return true, nil
+		}
+		if !migrate {
+			return false, nil
+		}
+		return true, index.coll.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: index.coll.Name()},
+			{Key: "index", Value: bson.D{
+				{Key: "name", Value: name},
+				{Key: "expireAfterSeconds", Value: expire},
+			}},
+		}).Err()
+	}
+	return true, nil
+}
+
+// backfillDeadAt 旧版本的死信没有 dead_at, 以标记为死信的时间补齐
+func (mq *MQueue) backfillDeadAt(ctx context.Context) error {
+	_, err := mq.Message.coll.UpdateMany(
+		ctx,
+		bson.M{"dead": true, "dead_at": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"dead_at": bson.M{"$ifNull": bson.A{"$deleted", "$$NOW"}}}}}},
+	)
+	return err
+}
+
+// archiveAcked Ack 已经生效, 写入历史集合失败时不影响 Ack 的结果, 只记录日志和 mqueue_archive_failed_total
+func (n *MessageNodeV2) archiveAcked(ctx context.Context, docs ...bson.Raw) {
+	if err := n.archive(ctx, docs...); err != nil {
+		n.archiveFailed(len(docs), err)
+	}
+}
+
+func (n *MessageNodeV2) archiveFailed(count int, err error) {
+	n.node.metrics.incArchiveFailed(count)
+	logger.GetLogger().WithField("collection", n.node.coll.Name()).Warnf("mqueue: archive %d acked messages: %v", count, err)
+}
+
+// archive Ack 后将消息复制到历史集合, 只有重复键的写入错误时忽略
+func (n *MessageNodeV2) archive(ctx context.Context, docs ...bson.Raw) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	items := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		items = append(items, doc)
+	}
+	_, err := n.node.sibling("history").InsertMany(ctx, items, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return nil
+	}
+	if failed, ferr := failedInserts(err); ferr == nil && len(failed) == 0 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package mqueue_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoRetention(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	name := "retention_" + primitive.NewObjectID().Hex()
+	coll := client.Database("mqueue_test").Collection(name)
+	defer coll.Drop(ctx)
+
+	open := func(opts mqueue.QueueOpts) {
+		opts.DB = mqueue.DBConfig{URI: uri, Database: "mqueue_test", Collection: name}
+		mq, err := mqueue.NewMQueueE(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mq.Close(ctx)
+	}
+	ttl := func() time.Duration {
+		cursor, err := coll.Indexes().List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var specs []struct {
+			Name   string `bson:"name"`
+			Expire *int32 `bson:"expireAfterSeconds"`
+		}
+		if err := cursor.All(ctx, &specs); err != nil {
+			t.Fatal(err)
+		}
+		for _, spec := range specs {
+			if spec.Name == "deleted_1" && spec.Expire != nil {
+				return time.Duration(*spec.Expire) * time.Second
+			}
+		}
+		return 0
+	}
+
+	partial := func() bool {
+		cursor, err := coll.Indexes().List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var specs []bson.M
+		if err := cursor.All(ctx, &specs); err != nil {
+			t.Fatal(err)
+		}
+		for _, spec := range specs {
+			if spec["name"] == "deleted_1" {
+				return spec["partialFilterExpression"] != nil
+			}
+		}
+		return false
+	}
+
+	month := 30 * 24 * time.Hour
+	open(mqueue.QueueOpts{DoneRetention: month})
+	if got := ttl(); got != month {
+		t.Fatal("created ttl", got)
+	}
+	// 没有设置保留时间的进程不修改已有的保留时间
+	open(mqueue.QueueOpts{})
+	if got := ttl(); got != month {
+		t.Error("ttl changed by default retention", got)
+	}
+	// 显式设置时修改
+	open(mqueue.QueueOpts{DoneRetention: 24 * time.Hour})
+	if got := ttl(); got != 24*time.Hour {
+		t.Error("migrated ttl", got)
+	}
+
+	// 旧版本没有过滤条件的索引被重建, 未设置保留时间时沿用已有的保留时间
+	if _, err := coll.Indexes().DropOne(ctx, "deleted_1"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "deleted", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(month.Seconds())),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(mqueue.QueueOpts{})
+	if got := ttl(); got != month {
+		t.Error("recreated ttl", got)
+	}
+	if !partial() {
+		t.Error("index not recreated with partial filter")
+	}
+}
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行. 旧版本写入的消息没有 priority, 启动时补齐后按写入顺序投递
+func TestMongoBackfillPriority(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	name := "priority_" + primitive.NewObjectID().Hex()
+	coll := client.Database("mqueue_test").Collection(name)
+	defer coll.Drop(ctx)
+
+	now := time.Now()
+	_, err = coll.InsertOne(ctx, bson.M{
+		"channel":   "a",
+		"ack":       primitive.NewObjectID().Hex(),
+		"message":   "legacy",
+		"created":   now.Add(-time.Minute),
+		"visible":   now.Add(-time.Minute),
+		"tries":     0,
+		"max_tries": 1,
+		"dead":      false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq, err := mqueue.NewMQueueWithDatabaseE(client.Database("mqueue_test"), mqueue.QueueOpts{
+		Mode: mqueue.DebugMode,
+		DB:   mqueue.DBConfig{Collection: name},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq.MessageV2.Add(ctx, mqueue.Message{Channel: "a", Message: "new", MaxTries: 1})
+	if message, err := mq.MessageV2.Get(ctx, "a"); err != nil || message.Message != "legacy" {
+		t.Error("legacy message should be delivered first", message, err)
+	}
+	if n, _ := coll.CountDocuments(ctx, bson.M{"priority": bson.M{"$exists": false}}); n != 0 {
+		t.Error("priority not backfilled", n)
+	}
+}
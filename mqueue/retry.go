@@ -0,0 +1,68 @@
+package mqueue
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type BackoffStrategy string
+
+const (
+	BackoffFixed       BackoffStrategy = "fixed"
+	BackoffLinear      BackoffStrategy = "linear"
+	BackoffExponential BackoffStrategy = "exponential"
+)
+
+// RetryPolicy 消息处理失败 (Nack) 后重新可见的延迟策略
+type RetryPolicy struct {
+	Strategy BackoffStrategy `bson:"strategy"`
+	Delay    time.Duration   `bson:"delay"`     // 基础延迟
+	MaxDelay time.Duration   `bson:"max_delay"` // 最大延迟, 0 表示不限制
+	Jitter   float64         `bson:"jitter"`    // 随机抖动比例 (0~1), 实际延迟在 [d*(1-Jitter), d] 之间
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Strategy: BackoffExponential,
+	Delay:    time.Second * 5,
+	MaxDelay: DefaultVisibility,
+	Jitter:   0.2,
+}
+
+// Backoff 计算第 tries 次投递失败后的延迟
+func (p RetryPolicy) Backoff(tries int) time.Duration {
+	if tries < 1 {
+		tries = 1
+	}
+	d := p.Delay
+	switch p.Strategy {
+	case BackoffLinear:
+		d = p.Delay * time.Duration(tries)
+	case BackoffExponential:
+		for i := 1; i < tries && d > 0; i++ {
+			if p.MaxDelay > 0 && d >= p.MaxDelay {
+				break
+			}
+			// 防止溢出
+			if d > math.MaxInt64/2 {
+				d = math.MaxInt64
+				break
+			}
+			d *= 2
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
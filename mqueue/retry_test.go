@@ -0,0 +1,50 @@
+package mqueue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+)
+
+func TestBackoffFixed(t *testing.T) {
+	p := mqueue.RetryPolicy{Strategy: mqueue.BackoffFixed, Delay: time.Second}
+	if p.Backoff(1) != time.Second || p.Backoff(5) != time.Second {
+		t.Error("fixed backoff error")
+	}
+}
+
+func TestBackoffLinear(t *testing.T) {
+	p := mqueue.RetryPolicy{Strategy: mqueue.BackoffLinear, Delay: time.Second, MaxDelay: 4 * time.Second}
+	if p.Backoff(3) != 3*time.Second {
+		t.Error("linear backoff error")
+	}
+	if p.Backoff(10) != 4*time.Second {
+		t.Error("max delay error")
+	}
+}
+
+func TestBackoffExponential(t *testing.T) {
+	p := mqueue.RetryPolicy{Strategy: mqueue.BackoffExponential, Delay: time.Second, MaxDelay: time.Minute}
+	if p.Backoff(1) != time.Second || p.Backoff(4) != 8*time.Second {
+		t.Error("exponential backoff error")
+	}
+	if p.Backoff(1000) != time.Minute {
+		t.Error("max delay error")
+	}
+
+	p.MaxDelay = 0
+	if p.Backoff(1000) <= 0 {
+		t.Error("overflow error")
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := mqueue.RetryPolicy{Strategy: mqueue.BackoffFixed, Delay: 10 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		d := p.Backoff(1)
+		if d < 5*time.Second || d > 10*time.Second {
+			t.Error("jitter error")
+		}
+	}
+}
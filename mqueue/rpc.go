@@ -0,0 +1,105 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 等待回复时的轮询间隔
+const (
+	minReplyPoll = 20 * time.Millisecond
+	maxReplyPoll = time.Second
+)
+
+// Reply 保存在 "<集合名>_replies" 中, 以关联 ID 为 _id
+type Reply struct {
+	Payload any       `bson:"payload"`
+	Error   string    `bson:"error,omitempty"`
+	Created time.Time `bson:"created"`
+}
+
+// Decode 将回复解码到 doc (需为指针)
+func (r *Reply) Decode(doc any) bool {
+	return decode(r.Payload, doc) == nil
+}
+
+// Call 写入请求并等待消费者回复, ctx 没有设置超时时使用 DefaultCallTimeout.
+// 消费者通过 ReplyError 回复时返回 ErrRemote
+func (n *MessageNodeV2) Call(ctx context.Context, channel string, payload any, opts ...PublishOpts) (*Reply, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+	var o PublishOpts
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+
+	correlationID := id()
+	message := o.message(channel, payload)
+	message.CorrelationID = correlationID
+	_, err := n.Add(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := n.node.sibling("replies")
+	wait := minReplyPoll
+	for {
+		reply := new(Reply)
+		err := replies.FindOne(ctx, bson.M{"_id": correlationID}).Decode(reply)
+		if err == nil {
+			if reply.Error != "" {
+				return reply, fmt.Errorf("%w: %s", ErrRemote, reply.Error)
+			}
+			return reply, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) && ctx.Err() == nil {
+			return nil, err
+		}
+
+		sleep(ctx, wait)
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCallTimeout, ctx.Err())
+		}
+		wait *= 2
+		if wait > maxReplyPoll {
+			wait = maxReplyPoll
+		}
+	}
+}
+
+// reply 只保留第一次回复, 消息重试后的重复回复会被忽略
+func (n *MessageNodeV2) reply(ctx context.Context, correlationID string, reply *Reply) error {
+	_, err := n.node.sibling("replies").UpdateOne(
+		ctx,
+		bson.M{"_id": correlationID},
+		bson.M{"$setOnInsert": reply},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// Reply 回复 Call 发出的请求
+func (item *QueueMessage) Reply(ctx context.Context, payload any) error {
+	return item.sendReply(ctx, &Reply{Payload: payload, Created: time.Now()})
+}
+
+// ReplyError 以错误回复 Call 发出的请求
+func (item *QueueMessage) ReplyError(ctx context.Context, err error) error {
+	return item.sendReply(ctx, &Reply{Error: err.Error(), Created: time.Now()})
+}
+
+func (item *QueueMessage) sendReply(ctx context.Context, reply *Reply) error {
+	if item.CorrelationID == "" || item.replier == nil {
+		return ErrNoReplyTo
+	}
+	return item.replier(ctx, item.CorrelationID, reply)
+}
@@ -0,0 +1,88 @@
+package mqueue_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestReplyWithoutCorrelation(t *testing.T) {
+	ctx := context.Background()
+	node := mqueue.NewMemoryNode(mqueue.MemoryOpts{})
+	node.Add(ctx, mqueue.Message{Channel: "a", Message: "a", MaxTries: 1})
+	message, err := node.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := message.Reply(ctx, "ok"); !errors.Is(err, mqueue.ErrNoReplyTo) {
+		t.Error("expect ErrNoReplyTo", err)
+	}
+}
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoCall(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	name := "rpc_" + primitive.NewObjectID().Hex()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database("mqueue_test")
+	mq, err := mqueue.NewMQueueWithDatabaseE(db, mqueue.QueueOpts{
+		Mode: mqueue.DebugMode,
+		DB:   mqueue.DBConfig{Collection: name},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.MessageV2.Clear(ctx)
+	defer db.Collection(name + "_replies").Drop(ctx)
+
+	workerCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	w := mqueue.NewWorker(mq.MessageV2, mqueue.WorkerOpts{PollInterval: 10 * time.Millisecond})
+	w.Handle("upper", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		s, _ := msg.Message.(string)
+		if s == "" {
+			return msg.ReplyError(ctx, errors.New("empty input"))
+		}
+		return msg.Reply(ctx, strings.ToUpper(s))
+	})
+	go w.Run(workerCtx)
+
+	callCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	// 没有设置 PublishOpts 时请求不会直接进入死信
+	reply, err := mq.MessageV2.Call(callCtx, "upper", "hello")
+	if err != nil {
+		t.Fatal("call error", err)
+	}
+	var result string
+	if !reply.Decode(&result) || result != "HELLO" {
+		t.Error("reply error", reply.Payload)
+	}
+
+	reply, err = mq.MessageV2.Call(callCtx, "upper", "", mqueue.PublishOpts{MaxTries: 1})
+	if !errors.Is(err, mqueue.ErrRemote) || reply == nil || reply.Error != "empty input" {
+		t.Error("expect remote error", reply, err)
+	}
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelTimeout()
+	if _, err := mq.MessageV2.Call(timeoutCtx, "nobody", "hello"); !errors.Is(err, mqueue.ErrCallTimeout) {
+		t.Error("expect ErrCallTimeout", err)
+	}
+}
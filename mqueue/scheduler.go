@@ -0,0 +1,204 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 触发一次定时任务的租约时长, 持有租约的实例崩溃后由其他实例接管
+const scheduleLease = time.Minute
+
+// Schedule 定时向 channel 写入消息, Cron 和 Interval 二选一
+type Schedule struct {
+	Name     string        `bson:"_id"`
+	Channel  string        `bson:"channel"`
+	Cron     string        `bson:"cron,omitempty"`
+	Interval time.Duration `bson:"interval,omitempty"`
+	Message  any           `bson:"message"`
+	MaxTries int           `bson:"max_tries"`
+	Priority int           `bson:"priority"`
+	Next     time.Time     `bson:"next"`
+}
+
+func (s *Schedule) next(after time.Time) (time.Time, error) {
+	if s.Cron != "" {
+		cron, err := ParseCron(s.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := cron.Next(after)
+		if next.IsZero() {
+			return next, fmt.Errorf("mqueue: cron expression %q never fires", s.Cron)
+		}
+		return next, nil
+	}
+	return after.Add(s.Interval), nil
+}
+
+// Scheduler 定时任务保存在 "<集合名>_schedules" 中, 多个实例同时运行时每次触发只会有一个实例写入消息
+type Scheduler struct {
+	node  *MessageNodeV2
+	coll  *mongo.Collection
+	owner string
+}
+
+func NewScheduler(mq *MQueue) *Scheduler {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknow"
+	}
+	return &Scheduler{
+		node:  mq.MessageV2,
+		coll:  mq.Message.sibling("schedules"),
+		owner: hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + id(),
+	}
+}
+
+// Register 新增或更新定时任务, 表达式未变化时保留下次触发时间
+func (s *Scheduler) Register(ctx context.Context, schedule Schedule) error {
+	if schedule.Name == "" || schedule.Channel == "" || schedule.Message == nil {
+		return ErrInvalidSchedule
+	}
+	if (schedule.Cron == "") == (schedule.Interval <= 0) {
+		return ErrInvalidSchedule
+	}
+	next, err := schedule.next(s.node.node.now())
+	if err != nil {
+		return err
+	}
+
+	existing := new(Schedule)
+	err = s.coll.FindOne(ctx, bson.M{"_id": schedule.Name}).Decode(existing)
+	found := err == nil
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	set := bson.M{
+		"channel":   schedule.Channel,
+		"cron":      schedule.Cron,
+		"interval":  schedule.Interval,
+		"message":   schedule.Message,
+		"max_tries": schedule.MaxTries,
+		"priority":  schedule.Priority,
+	}
+	if !found || existing.Cron != schedule.Cron || existing.Interval != schedule.Interval {
+		set["next"] = next
+	}
+	_, err = s.coll.UpdateOne(ctx, bson.M{"_id": schedule.Name}, bson.M{"$set": set}, options.Update().SetUpsert(true))
+	return err
+}
+
+// Remove
+func (s *Scheduler) Remove(ctx context.Context, name string) error {
+	_, err := s.coll.DeleteOne(ctx, bson.M{"_id": name})
+	return err
+}
+
+// List
+func (s *Scheduler) List(ctx context.Context) ([]*Schedule, error) {
+	result := make([]*Schedule, 0)
+	cursor, err := s.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Run 每隔 interval 检查一次到期的定时任务, 阻塞直到 ctx 取消.
+// Tick 的错误只记录日志, 不影响之后的检查
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	for ctx.Err() == nil {
+		if err := s.Tick(ctx); err != nil && ctx.Err() == nil {
+			logger.GetLogger().WithField("collection", s.coll.Name()).Warnf("mqueue: scheduler tick: %v", err)
+		}
+		sleep(ctx, interval)
+	}
+	return nil
+}
+
+// Tick 触发所有到期的定时任务, 一个定时任务失败时继续触发其他的, 返回合并后的错误
+func (s *Scheduler) Tick(ctx context.Context) error {
+	now := s.node.node.now()
+	cursor, err := s.coll.Find(ctx, bson.M{
+		"next": bson.M{"$lte": now},
+		"$or":  bson.A{bson.M{"lease_until": nil}, bson.M{"lease_until": bson.M{"$lte": now}}},
+	})
+	if err != nil {
+		return err
+	}
+	due := make([]*Schedule, 0)
+	if err = cursor.All(ctx, &due); err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for _, schedule := range due {
+		if err := s.fire(ctx, schedule); err != nil {
+			errs = append(errs, fmt.Errorf("schedule %s: %w", schedule.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fire 抢占租约后写入消息并计算下次触发时间
+func (s *Scheduler) fire(ctx context.Context, schedule *Schedule) error {
+	now := s.node.node.now()
+	res, err := s.coll.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":  schedule.Name,
+			"next": schedule.Next,
+			"$or":  bson.A{bson.M{"lease_until": nil}, bson.M{"lease_until": bson.M{"$lte": now}}},
+		},
+		bson.M{"$set": bson.M{"lease_owner": s.owner, "lease_until": now.Add(scheduleLease)}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount != 1 {
+		// 已被其他实例抢占
+		return nil
+	}
+
+	// 去重键保证租约过期被其他实例接管时同一次触发不会重复写入
+	_, err = s.node.Add(ctx, Message{
+		Channel:  schedule.Channel,
+		Message:  schedule.Message,
+		MaxTries: schedule.MaxTries,
+		Priority: schedule.Priority,
+		DedupKey: "schedule:" + schedule.Name + ":" + strconv.FormatInt(schedule.Next.Unix(), 10),
+	})
+	if err != nil {
+		return err
+	}
+
+	// 错过的触发时间不补发, 从当前时间计算下一次
+	next, err := schedule.next(now)
+	if err != nil {
+		return err
+	}
+	_, err = s.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": schedule.Name, "lease_owner": s.owner},
+		bson.M{
+			"$set":   bson.M{"next": next},
+			"$unset": bson.M{"lease_owner": "", "lease_until": ""},
+		},
+	)
+	return err
+}
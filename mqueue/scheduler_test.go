@@ -0,0 +1,52 @@
+package mqueue_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoScheduler(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	clock := mqueue.NewManualClock(time.Now().Truncate(time.Millisecond))
+	mq, err := mqueue.NewMQueueE(mqueue.QueueOpts{
+		Mode:  mqueue.DebugMode,
+		DB:    mqueue.DBConfig{URI: uri, Database: "mqueue_test", Collection: "scheduler_" + primitive.NewObjectID().Hex()},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.Close(ctx)
+	defer mq.MessageV2.Clear(ctx)
+
+	s := mqueue.NewScheduler(mq)
+	defer s.Remove(ctx, "every-minute")
+	if err := s.Register(ctx, mqueue.Schedule{Name: "every-minute", Channel: "a", Interval: time.Minute, Message: "tick", MaxTries: 1}); err != nil {
+		t.Fatal(err)
+	}
+	size := func() int64 {
+		n, _ := mq.MessageV2.Total(ctx, "a")
+		return n
+	}
+	if err := s.Tick(ctx); err != nil || size() != 0 {
+		t.Error("fired before due", err)
+	}
+	// 使用队列的时钟判断是否到期
+	clock.Advance(time.Minute)
+	if err := s.Tick(ctx); err != nil || size() != 1 {
+		t.Error("not fired", err)
+	}
+	if err := s.Tick(ctx); err != nil || size() != 1 {
+		t.Error("fired twice", err)
+	}
+}
@@ -0,0 +1,67 @@
+package mqueue
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ChannelStats 各状态的含义与 Size/InFlight/Done/Dead 一致
+type ChannelStats struct {
+	Channel     string     `bson:"_id"          json:"channel"`
+	Total       int64      `bson:"total"        json:"total"`
+	Ready       int64      `bson:"ready"        json:"ready"`
+	InFlight    int64      `bson:"in_flight"    json:"in_flight"`
+	Done        int64      `bson:"done"         json:"done"`
+	Dead        int64      `bson:"dead"         json:"dead"`
+	AvgTries    float64    `bson:"avg_tries"    json:"avg_tries"`
+	OldestReady *time.Time `bson:"oldest_ready" json:"oldest_ready"`
+	// 最早一条可见消息已等待的时长 (秒), 没有可见消息时为 0
+	OldestAge float64 `bson:"-" json:"oldest_age"`
+}
+
+// Stats 一次聚合返回每个 channel 的统计
+func (n *MessageNodeV2) Stats(ctx context.Context, channel ...string) ([]*ChannelStats, error) {
+	now := n.node.now()
+	active := bson.M{"$and": bson.A{
+		bson.M{"$eq": bson.A{"$dead", false}},
+		bson.M{"$lte": bson.A{"$deleted", nil}},
+	}}
+	ready := bson.M{"$and": bson.A{active, bson.M{"$lte": bson.A{"$visible", now}}}}
+	inFlight := bson.M{"$and": bson.A{active, bson.M{"$gt": bson.A{"$visible", now}}}}
+	count := func(cond any) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{cond, 1, 0}}}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: byChannel(bson.M{}, channel)}},
+		{{Key: "$group", Value: bson.M{
+			"_id":          "$channel",
+			"total":        bson.M{"$sum": 1},
+			"ready":        count(ready),
+			"in_flight":    count(inFlight),
+			"done":         count(bson.M{"$gt": bson.A{"$deleted", nil}}),
+			"dead":         count(bson.M{"$eq": bson.A{"$dead", true}}),
+			"avg_tries":    bson.M{"$avg": "$tries"},
+			"oldest_ready": bson.M{"$min": bson.M{"$cond": bson.A{ready, "$visible", nil}}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	result := make([]*ChannelStats, 0)
+	cursor, err := n.node.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &result); err != nil {
+		return result, err
+	}
+	for _, item := range result {
+		if item.OldestReady != nil {
+			item.OldestAge = now.Sub(*item.OldestReady).Seconds()
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,96 @@
+package mqueue
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Subscription 订阅保存在 "<集合名>_subscriptions" 中, 每个订阅对应一个独立的 channel
+type Subscription struct {
+	Channel string    `bson:"_id"     json:"channel"`
+	Topic   string    `bson:"topic"   json:"topic"`
+	Name    string    `bson:"name"    json:"name"`
+	Created time.Time `bson:"created" json:"created"`
+}
+
+// SubscriptionChannel 订阅对应的 channel, 消费者通过 Worker 处理这个 channel 上的消息
+func SubscriptionChannel(topic string, name string) string {
+	return topic + "/" + name
+}
+
+// Topic 发布到 topic 的消息会为每个订阅各写入一条, 各自独立重试, Ack 和进入死信
+type Topic struct {
+	node *MessageNodeV2
+	coll *mongo.Collection
+	name string
+}
+
+func NewTopic(mq *MQueue, name string) *Topic {
+	return &Topic{
+		node: mq.MessageV2,
+		coll: mq.Message.sibling("subscriptions"),
+		name: name,
+	}
+}
+
+// Subscribe 重复订阅不会报错, 返回订阅对应的 channel
+func (t *Topic) Subscribe(ctx context.Context, name string) (string, error) {
+	if name == "" {
+		return "", ErrInvalidMessage
+	}
+	channel := SubscriptionChannel(t.name, name)
+	_, err := t.coll.UpdateOne(
+		ctx,
+		bson.M{"_id": channel},
+		bson.M{"$setOnInsert": Subscription{Channel: channel, Topic: t.name, Name: name, Created: t.node.node.now()}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return "", err
+	}
+	return channel, nil
+}
+
+// Unsubscribe 已经写入的消息不受影响
+func (t *Topic) Unsubscribe(ctx context.Context, name string) error {
+	_, err := t.coll.DeleteOne(ctx, bson.M{"_id": SubscriptionChannel(t.name, name)})
+	return err
+}
+
+// Subscriptions
+func (t *Topic) Subscriptions(ctx context.Context) ([]*Subscription, error) {
+	result := make([]*Subscription, 0)
+	cursor, err := t.coll.Find(ctx, bson.M{"topic": t.name})
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// Publish 返回每个订阅上新增消息的 ID, 没有订阅时消息被丢弃
+func (t *Topic) Publish(ctx context.Context, payload any, opts PublishOpts) ([]string, error) {
+	if payload == nil {
+		return nil, ErrInvalidMessage
+	}
+	subscriptions, err := t.Subscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(subscriptions) == 0 {
+		return []string{}, nil
+	}
+
+	message := make([]Message, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		message = append(message, opts.message(sub.Channel, payload))
+	}
+	return t.node.Add(ctx, message...)
+}
@@ -0,0 +1,89 @@
+package mqueue_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// 设置 MQUEUE_TEST_MONGO_URI 时运行
+func TestMongoTopic(t *testing.T) {
+	uri := os.Getenv("MQUEUE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("MQUEUE_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	clock := mqueue.NewManualClock(time.Now().Truncate(time.Millisecond))
+	name := "topic_" + primitive.NewObjectID().Hex()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database("mqueue_test")
+	mq, err := mqueue.NewMQueueWithDatabaseE(db, mqueue.QueueOpts{
+		Mode:  mqueue.DebugMode,
+		DB:    mqueue.DBConfig{Collection: name},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mq.MessageV2.Clear(ctx)
+	defer db.Collection(name + "_subscriptions").Drop(ctx)
+
+	topic := mqueue.NewTopic(mq, "orders")
+	if ids, err := topic.Publish(ctx, "dropped", mqueue.PublishOpts{}); err != nil || len(ids) != 0 {
+		t.Error("publish without subscriptions", ids, err)
+	}
+	if _, err := topic.Subscribe(ctx, ""); err == nil {
+		t.Error("expect invalid name")
+	}
+	billing, err := topic.Subscribe(ctx, "billing")
+	if err != nil || billing != mqueue.SubscriptionChannel("orders", "billing") {
+		t.Fatal("subscribe error", billing, err)
+	}
+	// 重复订阅不报错, 不修改创建时间
+	clock.Advance(time.Minute)
+	topic.Subscribe(ctx, "billing")
+	shipping, _ := topic.Subscribe(ctx, "shipping")
+
+	subscriptions, err := topic.Subscriptions(ctx)
+	if err != nil || len(subscriptions) != 2 {
+		t.Fatal("subscriptions error", subscriptions, err)
+	}
+	for _, sub := range subscriptions {
+		if sub.Channel == billing && !sub.Created.Equal(clock.Now().Add(-time.Minute)) {
+			t.Error("created should use the queue clock", sub.Created)
+		}
+	}
+
+	ids, err := topic.Publish(ctx, "order-1", mqueue.PublishOpts{})
+	if err != nil || len(ids) != 2 {
+		t.Fatal("publish error", ids, err)
+	}
+	for _, channel := range []string{billing, shipping} {
+		message, err := mq.MessageV2.Get(ctx, channel)
+		if err != nil || message.Message != "order-1" || message.MaxTries != mqueue.DefaultMaxTries {
+			t.Error("fan-out error", channel, message, err)
+			continue
+		}
+		mq.MessageV2.Ack(ctx, message.Ack)
+	}
+
+	if err := topic.Unsubscribe(ctx, "billing"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := topic.Publish(ctx, "order-2", mqueue.PublishOpts{}); err != nil || len(ids) != 1 {
+		t.Error("publish after unsubscribe", ids, err)
+	}
+	if n, _ := mq.MessageV2.Size(ctx, billing); n != 0 {
+		t.Error("unsubscribed channel got message", n)
+	}
+}
@@ -0,0 +1,107 @@
+package mqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Meta 消息的元信息
+type Meta struct {
+	ID       string
+	Channel  string
+	Ack      string
+	Tries    int
+	MaxTries int
+	Headers  map[string]string
+}
+
+type PublishOpts struct {
+	Delay    time.Duration
+	MaxTries int // 为 0 时使用 DefaultMaxTries
+	Retry    *RetryPolicy
+	DedupKey string
+	Priority int
+	GroupKey string
+	Headers  map[string]string
+	// 取出后的租约时长, 为 0 时使用 QueueOpts.Visibility
+	Visibility time.Duration
+}
+
+// message channel 上的消息, 没有设置 MaxTries 的消息第一次取出时就会进入死信, 使用 DefaultMaxTries
+func (o PublishOpts) message(channel string, payload any) Message {
+	maxTries := o.MaxTries
+	if maxTries <= 0 {
+		maxTries = DefaultMaxTries
+	}
+	return Message{
+		Channel:    channel,
+		Message:    payload,
+		Delay:      o.Delay,
+		MaxTries:   maxTries,
+		Retry:      o.Retry,
+		DedupKey:   o.DedupKey,
+		Priority:   o.Priority,
+		GroupKey:   o.GroupKey,
+		Visibility: o.Visibility,
+		Headers:    o.Headers,
+	}
+}
+
+// TypedQueue 某个 channel 上固定类型的消息
+type TypedQueue[T any] struct {
+	node    IMessageNodeV2
+	channel string
+}
+
+func NewTypedQueue[T any](mq *MQueue, channel string) *TypedQueue[T] {
+	return NewTypedQueueWithNode[T](mq.MessageV2, channel)
+}
+
+// NewTypedQueueWithNode 使用指定的存储后端, 如测试中的 MemoryNode
+func NewTypedQueueWithNode[T any](node IMessageNodeV2, channel string) *TypedQueue[T] {
+	return &TypedQueue[T]{
+		node:    node,
+		channel: channel,
+	}
+}
+
+// Publish 返回消息 ID
+func (q *TypedQueue[T]) Publish(ctx context.Context, payload T, opts PublishOpts) (string, error) {
+	// 先编码为 BSON, 保证 struct 等类型写入后可以原样解码回 T
+	t, b, err := bson.MarshalValue(payload)
+	if err != nil {
+		return "", err
+	}
+	ids, err := q.node.Add(ctx, opts.message(q.channel, bson.RawValue{Type: t, Value: b}))
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// Consume 阻塞消费直到 ctx 取消, 解码失败的消息按处理失败处理
+func (q *TypedQueue[T]) Consume(ctx context.Context, handler func(ctx context.Context, payload T, meta Meta) error, opts ...WorkerOpts) error {
+	var o WorkerOpts
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	w := NewWorker(q.node, o)
+	w.Handle(q.channel, func(ctx context.Context, msg *QueueMessage) error {
+		var payload T
+		if err := decode(msg.Message, &payload); err != nil {
+			return fmt.Errorf("mqueue: decode message: %w", err)
+		}
+		return handler(ctx, payload, Meta{
+			ID:       msg.ID.Hex(),
+			Channel:  msg.Channel,
+			Ack:      msg.Ack,
+			Tries:    msg.Tries,
+			MaxTries: msg.MaxTries,
+			Headers:  msg.Headers,
+		})
+	})
+	return w.Run(ctx)
+}
@@ -0,0 +1,46 @@
+package mqueue_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+)
+
+type order struct {
+	ID    string   `bson:"id"`
+	Items []string `bson:"items"`
+	Total float64  `bson:"total"`
+}
+
+func TestTypedQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	node := mqueue.NewMemoryNode(mqueue.MemoryOpts{})
+	queue := mqueue.NewTypedQueueWithNode[order](node, "orders")
+
+	want := order{ID: "1", Items: []string{"a", "b"}, Total: 9.5}
+	id, err := queue.Publish(ctx, want, mqueue.PublishOpts{Headers: map[string]string{"k": "v"}})
+	if err != nil || id == "" {
+		t.Fatal("publish error", id, err)
+	}
+
+	var got order
+	var meta mqueue.Meta
+	err = queue.Consume(ctx, func(ctx context.Context, payload order, m mqueue.Meta) error {
+		got, meta = payload, m
+		cancel()
+		return nil
+	}, mqueue.WorkerOpts{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != want.ID || len(got.Items) != 2 || got.Items[1] != "b" || got.Total != want.Total {
+		t.Error("payload error", got)
+	}
+	// 没有设置 MaxTries 时使用默认值, 消息不会直接进入死信
+	if meta.ID != id || meta.Channel != "orders" || meta.Tries != 1 || meta.MaxTries != mqueue.DefaultMaxTries || meta.Headers["k"] != "v" {
+		t.Error("meta error", meta)
+	}
+}
@@ -0,0 +1,105 @@
+package mqueue
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// 自适应轮询的最小间隔
+const minWatchInterval = 100 * time.Millisecond
+
+// Watch 副本集上通过 change stream 在新消息写入时立即唤醒, 单机部署时退化为自适应轮询:
+// 队列为空时轮询间隔逐步加倍直到 interval, 取到消息后恢复到最小间隔.
+// ctx 取消或 MQueue.Close 后停止并关闭 channel
+func (n *MessageNodeV2) Watch(ctx context.Context, interval time.Duration, channel ...string) <-chan *QueueMessage {
+	return n.watch(ctx, interval, channel)
+}
+
+func (n *MessageNodeV2) watch(ctx context.Context, interval time.Duration, channel []string) chan *QueueMessage {
+	// MQueue.Close 时停止
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-n.node.closed:
+		case <-ctx.Done():
+		}
+	}()
+	return poll(ctx, interval, n.inserted(ctx, channel), func(ctx context.Context) (*QueueMessage, error) {
+		return n.Get(ctx, channel...)
+	})
+}
+
+// poll 自适应轮询 get, wake 有信号时立即重新获取; ctx 取消后关闭返回的 channel
+func poll(ctx context.Context, interval time.Duration, wake <-chan struct{}, get func(ctx context.Context) (*QueueMessage, error)) chan *QueueMessage {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	least := minWatchInterval
+	if least > interval {
+		least = interval
+	}
+
+	c := make(chan *QueueMessage)
+	go func() {
+		defer close(c)
+		wait := least
+		for ctx.Err() == nil {
+			q, err := get(ctx)
+			if err == nil {
+				wait = least
+				select {
+				case c <- q:
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			// 延迟消息和租约过期的消息不会产生写入事件, 仍需定时检查
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+			case <-wake:
+				wait = least
+			case <-timer.C:
+				wait *= 2
+				if wait > interval {
+					wait = interval
+				}
+			}
+			timer.Stop()
+		}
+	}()
+	return c
+}
+
+// inserted 通过 change stream 监听新写入的消息, 不支持 change stream 时返回 nil
+func (n *MessageNodeV2) inserted(ctx context.Context, channel []string) <-chan struct{} {
+	match := bson.M{"operationType": bson.M{"$in": bson.A{"insert", "replace"}}}
+	switch len(channel) {
+	case 0:
+	case 1:
+		match["fullDocument.channel"] = channel[0]
+	default:
+		match["fullDocument.channel"] = bson.M{"$in": channel}
+	}
+	stream, err := n.node.coll.Watch(ctx, mongo.Pipeline{{{Key: "$match", Value: match}}})
+	if err != nil {
+		return nil
+	}
+
+	c := make(chan struct{}, 1)
+	go func() {
+		defer stream.Close(context.Background())
+		for stream.Next(ctx) {
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return c
+}
@@ -0,0 +1,206 @@
+package mqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPollInterval = time.Second
+	DefaultPingInterval = DefaultVisibility / 3
+)
+
+// Handler 返回 nil 时消息会被 Ack, 否则 Nack 并按 RetryPolicy 延迟重试
+type Handler func(ctx context.Context, msg *QueueMessage) error
+
+type WorkerOpts struct {
+	Concurrency  int                                // 并发 goroutine 数量, 默认 1
+	PollInterval time.Duration                      // 队列为空时的轮询间隔
+	PingInterval time.Duration                      // handler 运行期间续租的间隔, 最长为本次租约时长 (QueueMessage.Lease) 的 1/3
+	OnError      func(msg *QueueMessage, err error) // 获取消息失败时 msg 为 nil; 续租失败时为 ErrLeaseLost, 同时取消 handler 的 ctx
+}
+
+type Worker struct {
+	node     IMessageNodeV2
+	opts     WorkerOpts
+	metrics  *Metrics
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewWorker(node IMessageNodeV2, opts WorkerOpts) *Worker {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = DefaultPingInterval
+	}
+	w := &Worker{
+		node:     node,
+		opts:     opts,
+		handlers: make(map[string]Handler),
+	}
+	// 记录 handler 耗时
+	if p, ok := node.(interface{ Metrics() *Metrics }); ok {
+		w.metrics = p.Metrics()
+	}
+	return w
+}
+
+// Handle 注册 channel 的处理函数, 重复注册会覆盖
+func (w *Worker) Handle(channel string, handler Handler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handlers[channel] = handler
+}
+
+// channels 已注册的 channel, Worker 只从这些 channel 获取消息
+func (w *Worker) channels() []string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	channels := make([]string, 0, len(w.handlers))
+	for channel := range w.handlers {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func (w *Worker) handler(channel string) (Handler, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	h, ok := w.handlers[channel]
+	return h, ok
+}
+
+// Run 阻塞运行直到 ctx 被取消, 取消后不再拉取新消息, 等待处理中的消息完成后返回
+func (w *Worker) Run(ctx context.Context) error {
+	w.mu.RLock()
+	n := len(w.handlers)
+	w.mu.RUnlock()
+	if n == 0 {
+		return ErrNoHandler
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		m, err := w.node.Get(ctx, w.channels()...)
+		if err != nil {
+			if !errors.Is(err, ErrEmpty) && ctx.Err() == nil {
+				w.onError(nil, err)
+			}
+			sleep(ctx, w.opts.PollInterval)
+			continue
+		}
+		w.process(ctx, m)
+	}
+}
+
+func (w *Worker) process(ctx context.Context, m *QueueMessage) {
+	h, ok := w.handler(m.Channel)
+	if !ok {
+		w.onError(m, fmt.Errorf("%w: %s", ErrNoHandler, m.Channel))
+		return
+	}
+
+	// 已经取出的消息需要处理完, 不随 ctx 取消, 只在租约丢失时取消
+	base := ContextWithHeaders(context.WithoutCancel(ctx), m.Headers)
+	hctx, cancel := context.WithCancel(base)
+	defer cancel()
+	done := make(chan struct{})
+	alive := make(chan bool, 1)
+	go func() {
+		ok := w.keepalive(base, m, done)
+		if !ok {
+			cancel()
+		}
+		alive <- ok
+	}()
+	start := time.Now()
+	err := call(hctx, h, m)
+	w.metrics.ObserveHandler(m.Channel, time.Since(start))
+	close(done)
+
+	// 等待续租结束, 避免 Ack 之后还有 Ping
+	if !<-alive {
+		// ack 已失效, 消息由新的租约持有者处理
+		return
+	}
+	if err != nil {
+		w.onError(m, err)
+		if err := w.node.Nack(base, m.Ack, NackOpts{Error: err.Error()}); err != nil {
+			w.onError(m, err)
+		}
+		return
+	}
+	if err := w.node.Ack(base, m.Ack); err != nil {
+		w.onError(m, fmt.Errorf("%w: %v", ErrAckFailed, err))
+	}
+}
+
+// keepalive 定时 Ping 延长租约, 防止处理时间过长导致消息被重复投递; 租约已丢失时返回 false
+func (w *Worker) keepalive(ctx context.Context, m *QueueMessage, done chan struct{}) bool {
+	interval := w.opts.PingInterval
+	if v := m.Lease / 3; v > 0 && v < interval {
+		interval = v
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return true
+		case <-ticker.C:
+			err := w.node.Ping(ctx, m.Ack)
+			if errors.Is(err, ErrNotFound) {
+				w.onError(m, fmt.Errorf("%w: %v", ErrLeaseLost, err))
+				return false
+			}
+			if err != nil {
+				w.onError(m, err)
+			}
+		}
+	}
+}
+
+func (w *Worker) onError(m *QueueMessage, err error) {
+	if w.opts.OnError != nil {
+		w.opts.OnError(m, err)
+	}
+}
+
+func call(ctx context.Context, h Handler, m *QueueMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("mqueue: handler panic: %v", r)
+		}
+	}()
+	return h(ctx, m)
+}
+
+// sleep 等待 d 或 ctx 取消
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,226 @@
+package mqueue_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yaoshangnetwork/gobase/mqueue"
+)
+
+type fakeNode struct {
+	mu      sync.Mutex
+	queue   []*mqueue.QueueMessage
+	acked   []string
+	pinged  int
+	pingErr error
+}
+
+func (f *fakeNode) Add(ctx context.Context, message ...mqueue.Message) ([]string, error) {
+	return nil, nil
+}
+func (f *fakeNode) Clear(ctx context.Context) error { return nil }
+func (f *fakeNode) Watch(ctx context.Context, interval time.Duration, channel ...string) <-chan *mqueue.QueueMessage {
+	return nil
+}
+func (f *fakeNode) Ping(ctx context.Context, ack string, extend ...time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pinged++
+	return f.pingErr
+}
+func (f *fakeNode) GetBatch(ctx context.Context, channel string, n int) ([]*mqueue.QueueMessage, error) {
+	return nil, mqueue.ErrEmpty
+}
+func (f *fakeNode) AckBatch(ctx context.Context, acks []string) (int64, error) {
+	return 0, nil
+}
+func (f *fakeNode) Nack(ctx context.Context, ack string, opts mqueue.NackOpts) error {
+	return nil
+}
+func (f *fakeNode) Total(ctx context.Context, channel ...string) (int64, error) {
+	return 0, nil
+}
+func (f *fakeNode) Size(ctx context.Context, channel ...string) (int64, error) {
+	return 0, nil
+}
+func (f *fakeNode) InFlight(ctx context.Context, channel ...string) (int64, error) {
+	return 0, nil
+}
+func (f *fakeNode) Done(ctx context.Context, channel ...string) (int64, error) {
+	return 0, nil
+}
+func (f *fakeNode) Dead(ctx context.Context, channel ...string) (int64, error) {
+	return 0, nil
+}
+func (f *fakeNode) Get(ctx context.Context, channel ...string) (*mqueue.QueueMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queue) == 0 {
+		return nil, mqueue.ErrEmpty
+	}
+	m := f.queue[0]
+	f.queue = f.queue[1:]
+	return m, nil
+}
+func (f *fakeNode) Ack(ctx context.Context, ack string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acked = append(f.acked, ack)
+	return nil
+}
+
+func TestWorkerRun(t *testing.T) {
+	node := &fakeNode{queue: []*mqueue.QueueMessage{
+		{Channel: "a", Ack: "1"},
+		{Channel: "a", Ack: "2"},
+		{Channel: "b", Ack: "3"},
+	}}
+	w := mqueue.NewWorker(node, mqueue.WorkerOpts{Concurrency: 2, PollInterval: time.Millisecond})
+
+	var mu sync.Mutex
+	handled := 0
+	w.Handle("a", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+		return nil
+	})
+	w.Handle("b", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		return errors.New("fail")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.Run(ctx); err != nil {
+		t.Error(err)
+	}
+	if handled != 2 {
+		t.Error("handled error")
+	}
+	if len(node.acked) != 2 {
+		t.Error("ack error")
+	}
+}
+
+func TestWorkerNoHandler(t *testing.T) {
+	w := mqueue.NewWorker(&fakeNode{}, mqueue.WorkerOpts{})
+	if err := w.Run(context.Background()); !errors.Is(err, mqueue.ErrNoHandler) {
+		t.Error("expect ErrNoHandler")
+	}
+}
+
+func TestWorkerKeepalive(t *testing.T) {
+	node := &fakeNode{queue: []*mqueue.QueueMessage{{Channel: "a", Ack: "1"}}}
+	w := mqueue.NewWorker(node, mqueue.WorkerOpts{PollInterval: time.Millisecond, PingInterval: 10 * time.Millisecond})
+	w.Handle("a", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w.Run(ctx)
+	node.mu.Lock()
+	pinged := node.pinged
+	node.mu.Unlock()
+	if pinged < 5 {
+		t.Error("ping error", pinged)
+	}
+	if len(node.acked) != 1 {
+		t.Error("ack error")
+	}
+}
+
+// ctx 取消后等待处理中的消息完成并 Ack, handler 的 ctx 不随之取消
+func TestWorkerGracefulStop(t *testing.T) {
+	node := &fakeNode{queue: []*mqueue.QueueMessage{{Channel: "a", Ack: "1"}}}
+	w := mqueue.NewWorker(node, mqueue.WorkerOpts{PollInterval: time.Millisecond})
+	started := make(chan struct{})
+	finished := false
+	var handlerErr error
+	w.Handle("a", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		handlerErr = ctx.Err()
+		finished = true
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	w.Run(ctx)
+	if !finished || handlerErr != nil {
+		t.Error("handler should finish with a live ctx", finished, handlerErr)
+	}
+	if len(node.acked) != 1 {
+		t.Error("ack error")
+	}
+}
+
+// 队列的可见时间远小于默认的续租间隔时, 按本次租约时长续租, 消息只被投递一次
+func TestWorkerShortVisibility(t *testing.T) {
+	node := mqueue.NewMemoryNode(mqueue.MemoryOpts{Visibility: 50 * time.Millisecond})
+	node.Add(context.Background(), mqueue.Message{Channel: "a", Message: "x", MaxTries: 5})
+	w := mqueue.NewWorker(node, mqueue.WorkerOpts{Concurrency: 2, PollInterval: time.Millisecond})
+
+	var mu sync.Mutex
+	delivered := 0
+	w.Handle("a", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		mu.Lock()
+		delivered++
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	w.Run(ctx)
+	if delivered != 1 {
+		t.Error("delivered", delivered)
+	}
+	if done, _ := node.Done(context.Background(), "a"); done != 1 {
+		t.Error("ack error", done)
+	}
+}
+
+func TestWorkerLeaseLost(t *testing.T) {
+	node := &fakeNode{
+		queue:   []*mqueue.QueueMessage{{Channel: "a", Ack: "1", Lease: 30 * time.Millisecond}},
+		pingErr: mqueue.ErrNotFound,
+	}
+	var lost error
+	w := mqueue.NewWorker(node, mqueue.WorkerOpts{
+		PollInterval: time.Millisecond,
+		OnError: func(msg *mqueue.QueueMessage, err error) {
+			lost = err
+		},
+	})
+	canceled := false
+	w.Handle("a", func(ctx context.Context, msg *mqueue.QueueMessage) error {
+		select {
+		case <-ctx.Done():
+			canceled = true
+		case <-time.After(time.Second):
+		}
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w.Run(ctx)
+	if !canceled {
+		t.Error("handler ctx should be canceled")
+	}
+	if !errors.Is(lost, mqueue.ErrLeaseLost) {
+		t.Error("expect ErrLeaseLost", lost)
+	}
+	if len(node.acked) != 0 {
+		t.Error("lost message should not be acked")
+	}
+}
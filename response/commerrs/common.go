@@ -12,5 +12,8 @@ var ErrInvalidObjectID = &APIError{100001, "invalid ID format"}
 // 没有找到数据
 var ErrDataNotFound = &APIError{100002, "requested data not found"}
 
+// 请求参数不正确
+var ErrInvalidParams = &APIError{100003, "invalid params"}
+
 // 服务错误 (用作兜底)
 var ErrServiceError = &APIError{100999, "service error"}